@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"sync"
+	"time"
+)
+
+// MinTTL is the minimum duration to keep address to name mapping.
+// Clients may connect after the record is expired
+const MinTTL = 5 * time.Minute
+
+// DefaultMaxEntries is the default number of mappings kept by Cache
+const DefaultMaxEntries = 65536
+
+// sweepInterval is interval to remove expired mappings in Record
+const sweepInterval = time.Minute
+
+type cacheEntry struct {
+	name    string
+	expires time.Time
+}
+
+// Cache records address to name mappings seen in dns responses
+type Cache struct {
+	// MaxEntries is the max number of mappings. When it is reached,
+	// expired mappings are removed and then arbitrary ones are evicted
+	MaxEntries int
+
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	now       func() time.Time
+	nextSweep time.Time
+}
+
+// NewCache creates Cache
+func NewCache() *Cache {
+	return &Cache{
+		MaxEntries: DefaultMaxEntries,
+		entries:    map[string]cacheEntry{},
+		now:        time.Now,
+	}
+}
+
+// Len returns the number of mappings including expired ones not removed yet
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// sweep removes expired mappings
+func (c *Cache) sweep(now time.Time) {
+	for ip, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, ip)
+		}
+	}
+	c.nextSweep = now.Add(sweepInterval)
+}
+
+// evict removes mappings until one can be added
+func (c *Cache) evict(now time.Time) {
+	if c.MaxEntries <= 0 || len(c.entries) < c.MaxEntries {
+		return
+	}
+	c.sweep(now)
+	for ip := range c.entries {
+		if len(c.entries) < c.MaxEntries {
+			return
+		}
+		delete(c.entries, ip)
+	}
+}
+
+// Record records answers of message
+func (c *Cache) Record(m *Message) {
+	if m.Question == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.After(c.nextSweep) {
+		c.sweep(now)
+	}
+	for _, r := range m.Answers {
+		if r.IP == nil {
+			continue
+		}
+		ttl := r.TTL
+		if ttl < MinTTL {
+			ttl = MinTTL
+		}
+		ip := r.IP.String()
+		if _, ok := c.entries[ip]; !ok {
+			c.evict(now)
+		}
+		c.entries[ip] = cacheEntry{name: m.Question, expires: now.Add(ttl)}
+	}
+}
+
+// Lookup returns name for ip address
+func (c *Cache) Lookup(ip string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[ip]
+	if !ok {
+		return "", false
+	}
+	if c.now().After(e.expires) {
+		delete(c.entries, ip)
+		return "", false
+	}
+	return e.name, true
+}
@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func answer(name string, ttl time.Duration, ips ...string) *Message {
+	m := &Message{Response: true, Question: name}
+	for _, ip := range ips {
+		m.Answers = append(m.Answers, Record{Name: name, Type: TypeA, TTL: ttl, IP: net.ParseIP(ip)})
+	}
+	return m
+}
+
+func TestCacheLookup(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewCache()
+	c.now = func() time.Time { return now }
+	c.Record(answer("a.example.com", time.Hour, "192.0.2.1"))
+	if name, ok := c.Lookup("192.0.2.1"); !ok || name != "a.example.com" {
+		t.Errorf("name=%s ok=%v", name, ok)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, ok := c.Lookup("192.0.2.1"); ok {
+		t.Error("expired mapping is returned")
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewCache()
+	c.now = func() time.Time { return now }
+	c.Record(answer("a.example.com", 0, "192.0.2.1", "192.0.2.2"))
+	c.Record(answer("b.example.com", time.Hour, "192.0.2.3"))
+
+	// expired mappings are removed without lookup
+	now = now.Add(MinTTL + sweepInterval + time.Second)
+	c.Record(answer("c.example.com", 0, "192.0.2.4"))
+	if c.Len() != 2 {
+		t.Errorf("len=%d", c.Len())
+	}
+	if _, ok := c.Lookup("192.0.2.3"); !ok {
+		t.Error("unexpired mapping is removed")
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c := NewCache()
+	c.MaxEntries = 3
+	for n := 1; n <= 10; n++ {
+		c.Record(answer(fmt.Sprintf("%d.example.com", n), time.Hour, fmt.Sprintf("192.0.2.%d", n)))
+		if c.Len() > 3 {
+			t.Fatalf("len=%d", c.Len())
+		}
+	}
+	if name, ok := c.Lookup("192.0.2.10"); !ok || name != "10.example.com" {
+		t.Errorf("latest mapping is evicted: name=%s ok=%v", name, ok)
+	}
+	// updating existing mapping does not evict others
+	c.Record(answer("11.example.com", time.Hour, "192.0.2.10"))
+	if c.Len() != 3 {
+		t.Errorf("len=%d", c.Len())
+	}
+}
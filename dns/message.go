@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// record types
+const (
+	TypeA     = 1
+	TypeCNAME = 5
+	TypeAAAA  = 28
+)
+
+const headerSize = 12
+
+var errShortMessage = errors.New("dns message is too short")
+
+// Record represents resource record in answer section
+type Record struct {
+	Name string
+	Type uint16
+	TTL  time.Duration
+	IP   net.IP
+}
+
+// Message represents parsed dns message. Only fields used by traproxy are parsed
+type Message struct {
+	ID       uint16
+	Response bool
+	Question string
+	Answers  []Record
+}
+
+// ParseMessage parses dns message
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < headerSize {
+		return nil, errShortMessage
+	}
+	m := &Message{
+		ID:       binary.BigEndian.Uint16(b[0:2]),
+		Response: b[2]&0x80 != 0,
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:6]))
+	ancount := int(binary.BigEndian.Uint16(b[6:8]))
+
+	off := headerSize
+	for i := 0; i < qdcount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+		if off > len(b) {
+			return nil, errShortMessage
+		}
+		if i == 0 {
+			m.Question = name
+		}
+	}
+
+	for i := 0; i < ancount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+10 > len(b) {
+			return nil, errShortMessage
+		}
+		typ := binary.BigEndian.Uint16(b[off : off+2])
+		ttl := binary.BigEndian.Uint32(b[off+4 : off+8])
+		rdlen := int(binary.BigEndian.Uint16(b[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(b) {
+			return nil, errShortMessage
+		}
+		rdata := b[off : off+rdlen]
+		off += rdlen
+
+		r := Record{Name: name, Type: typ, TTL: time.Duration(ttl) * time.Second}
+		switch {
+		case typ == TypeA && rdlen == net.IPv4len:
+			r.IP = net.IP(append([]byte{}, rdata...))
+		case typ == TypeAAAA && rdlen == net.IPv6len:
+			r.IP = net.IP(append([]byte{}, rdata...))
+		}
+		m.Answers = append(m.Answers, r)
+	}
+	return m, nil
+}
+
+// readName reads domain name at off and returns name and offset after the name
+func readName(b []byte, off int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			jumps++
+			if jumps > 16 {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			off = int(binary.BigEndian.Uint16(b[off:off+2]) & 0x3fff)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
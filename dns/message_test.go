@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func buildQuery(id uint16, name string) []byte {
+	return NewQuery(id, name, TypeA)
+}
+
+// buildResponse builds response for query with A record using compression pointer
+func buildResponse(query []byte, ip net.IP, ttl uint32) []byte {
+	b := append([]byte{}, query...)
+	b[2] |= 0x80
+	binary.BigEndian.PutUint16(b[6:8], 1)
+	if ip.To4() == nil {
+		b = append(b, 0xc0, headerSize, 0, TypeAAAA, 0, 1)
+	} else {
+		b = append(b, 0xc0, headerSize, 0, TypeA, 0, 1)
+		ip = ip.To4()
+	}
+	var t [4]byte
+	binary.BigEndian.PutUint32(t[:], ttl)
+	b = append(b, t[:]...)
+	b = append(b, 0, byte(len(ip)))
+	b = append(b, ip...)
+	return b
+}
+
+func TestParseMessage(t *testing.T) {
+	q := buildQuery(1234, "WWW.Example.com")
+	m, err := ParseMessage(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 1234 || m.Response || m.Question != "www.example.com" || len(m.Answers) != 0 {
+		t.Errorf("invalid query: %+v", m)
+	}
+
+	r := buildResponse(q, net.ParseIP("192.0.2.1"), 30)
+	m, err = ParseMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Response || len(m.Answers) != 1 {
+		t.Fatalf("invalid response: %+v", m)
+	}
+	a := m.Answers[0]
+	if a.Name != "www.example.com" || a.Type != TypeA || a.TTL != 30*time.Second || !a.IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("invalid answer: %+v", a)
+	}
+}
+
+func TestParseMessageError(t *testing.T) {
+	q := buildQuery(1, "example.com")
+	var tests = [][]byte{
+		q[:5],
+		q[:len(q)-3],
+		append(q[:headerSize:headerSize], 0xc0, headerSize),
+	}
+	for _, v := range tests {
+		if _, err := ParseMessage(v); err == nil {
+			t.Errorf("error not returned: %v", v)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := NewCache()
+	c.now = func() time.Time { return now }
+
+	m, _ := ParseMessage(buildResponse(buildQuery(1, "example.com"), net.ParseIP("192.0.2.1"), 30))
+	c.Record(m)
+	if name, ok := c.Lookup("192.0.2.1"); !ok || name != "example.com" {
+		t.Errorf("lookup failed: %s", name)
+	}
+	if _, ok := c.Lookup("192.0.2.2"); ok {
+		t.Error("unknown address found")
+	}
+
+	now = now.Add(MinTTL + time.Second)
+	if _, ok := c.Lookup("192.0.2.1"); ok {
+		t.Error("expired entry found")
+	}
+}
@@ -0,0 +1,198 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolvConf is path of resolv.conf to find system dns server
+var ResolvConf = "/etc/resolv.conf"
+
+// refresh intervals of NameWatcher
+var (
+	MinRefresh   = 10 * time.Second
+	MaxRefresh   = time.Hour
+	RetryRefresh = 30 * time.Second
+)
+
+// NewQuery returns dns query message for name
+func NewQuery(id uint16, name string, typ uint16) []byte {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	b[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(b[4:6], 1)
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	b = append(b, 0)
+	var t [4]byte
+	binary.BigEndian.PutUint16(t[0:2], typ)
+	binary.BigEndian.PutUint16(t[2:4], 1)
+	return append(b, t[:]...)
+}
+
+// Resolve queries records of typ for name to server
+func Resolve(server, name string, typ uint16) ([]Record, error) {
+	c, err := net.DialTimeout("udp", server, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(Timeout))
+
+	id := uint16(rand.Intn(1 << 16))
+	if _, err := c.Write(NewQuery(id, name, typ)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		m, err := ParseMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !m.Response || m.ID != id {
+			continue
+		}
+		records := []Record{}
+		for _, r := range m.Answers {
+			if r.IP != nil && r.Type == typ {
+				records = append(records, r)
+			}
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("no address for %s", name)
+		}
+		return records, nil
+	}
+}
+
+// SystemServer returns first nameserver in resolv.conf
+func SystemServer() (string, error) {
+	f, err := os.Open(ResolvConf)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("nameserver not found in " + ResolvConf)
+}
+
+// NameWatcher resolves ipv4 and ipv6 addresses of names periodically by its TTL
+type NameWatcher struct {
+	Server string
+	Names  []string
+	// OnChange is called with all addresses of Names when addresses are changed
+	OnChange func(addrs []string)
+
+	mu    sync.Mutex
+	addrs map[string][]string
+}
+
+// Start resolves all names and starts refreshing them until stop is closed
+func (w *NameWatcher) Start(stop <-chan struct{}) error {
+	w.addrs = map[string][]string{}
+	intervals := map[string]time.Duration{}
+	for _, name := range w.Names {
+		interval, err := w.resolve(name)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %s", name, err)
+		}
+		intervals[name] = interval
+	}
+	w.notify()
+
+	for _, name := range w.Names {
+		go w.refresh(name, intervals[name], stop)
+	}
+	return nil
+}
+
+func (w *NameWatcher) refresh(name string, interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		var err error
+		interval, err = w.resolve(name)
+		if err != nil {
+			log.Printf("failed to resolve %s: %s", name, err)
+			interval = RetryRefresh
+			continue
+		}
+		w.notify()
+	}
+}
+
+func (w *NameWatcher) resolve(name string) (time.Duration, error) {
+	records, err := Resolve(w.Server, name, TypeA)
+	// name may have only ipv6 addresses
+	if records6, err6 := Resolve(w.Server, name, TypeAAAA); err6 == nil {
+		records = append(records, records6...)
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	interval := MaxRefresh
+	addrs := []string{}
+	for _, r := range records {
+		addrs = append(addrs, r.IP.String())
+		if r.TTL < interval {
+			interval = r.TTL
+		}
+	}
+	if interval < MinRefresh {
+		interval = MinRefresh
+	}
+	w.mu.Lock()
+	w.addrs[name] = addrs
+	w.mu.Unlock()
+	return interval, nil
+}
+
+// Addrs returns all resolved addresses
+func (w *NameWatcher) Addrs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seen := map[string]bool{}
+	addrs := []string{}
+	for _, as := range w.addrs {
+		for _, a := range as {
+			if !seen[a] {
+				seen[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (w *NameWatcher) notify() {
+	if w.OnChange != nil {
+		w.OnChange(w.Addrs())
+	}
+}
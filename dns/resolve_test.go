@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	records, err := Resolve(startFakeUpstream(t), "example.com", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].IP.String() != "192.0.2.1" || records[0].TTL != time.Minute {
+		t.Errorf("invalid records: %+v", records)
+	}
+
+	records, err = Resolve(startFakeUpstream(t), "example.com", TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].IP.String() != "2001:db8::1" {
+		t.Errorf("invalid records: %+v", records)
+	}
+}
+
+func TestSystemServer(t *testing.T) {
+	orig := ResolvConf
+	defer func() { ResolvConf = orig }()
+
+	ResolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+	os.WriteFile(ResolvConf, []byte("# comment\nsearch example.com\nnameserver 192.0.2.53\n"), 0644)
+	server, err := SystemServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "192.0.2.53:53" {
+		t.Errorf("invalid server: %s", server)
+	}
+
+	os.WriteFile(ResolvConf, []byte("search example.com\n"), 0644)
+	if _, err := SystemServer(); err == nil {
+		t.Error("error not returned")
+	}
+}
+
+func TestNameWatcher(t *testing.T) {
+	origMin := MinRefresh
+	defer func() { MinRefresh = origMin }()
+	MinRefresh = time.Millisecond
+
+	changes := make(chan []string, 10)
+	w := &NameWatcher{
+		Server:   startFakeUpstream(t),
+		Names:    []string{"a.example.com", "b.example.com"},
+		OnChange: func(addrs []string) { changes <- addrs },
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := w.Start(stop); err != nil {
+		t.Fatal(err)
+	}
+	got := <-changes
+	if !reflect.DeepEqual(got, []string{"192.0.2.1", "2001:db8::1"}) {
+		t.Errorf("invalid addrs: %v", got)
+	}
+}
+
+func TestNameWatcherError(t *testing.T) {
+	w := &NameWatcher{Server: "127.0.0.1:1", Names: []string{"example.com"}}
+	orig := Timeout
+	defer func() { Timeout = orig }()
+	Timeout = 100 * time.Millisecond
+	if err := w.Start(nil); err == nil {
+		t.Error("error not returned")
+	}
+}
@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Timeout is timeout for queries to upstream
+var Timeout = 5 * time.Second
+
+const maxUDPSize = 65535
+
+// Server forwards dns queries to upstream and records responses to Cache
+type Server struct {
+	Upstream string
+	Cache    *Cache
+}
+
+func (s *Server) record(resp []byte) {
+	m, err := ParseMessage(resp)
+	if err != nil {
+		log.Printf("failed to parse dns response: %s", err)
+		return
+	}
+	s.Cache.Record(m)
+}
+
+// ServeUDP serves dns queries over udp
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	for {
+		buf := make([]byte, maxUDPSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			resp, err := s.forwardUDP(buf[:n])
+			if err != nil {
+				log.Printf("failed to forward dns query: %s", err)
+				return
+			}
+			s.record(resp)
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				log.Printf("failed to write dns response: %s", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) forwardUDP(query []byte) ([]byte, error) {
+	c, err := net.DialTimeout("udp", s.Upstream, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(Timeout))
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// ServeTCP serves dns queries over tcp
+func (s *Server) ServeTCP(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleTCP(c)
+	}
+}
+
+func (s *Server) handleTCP(c net.Conn) {
+	defer c.Close()
+
+	up, err := net.DialTimeout("tcp", s.Upstream, Timeout)
+	if err != nil {
+		log.Printf("failed to connect dns upstream: %s", err)
+		return
+	}
+	defer up.Close()
+
+	for {
+		query, err := readTCPMessage(c)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("failed to read dns query: %s", err)
+			}
+			return
+		}
+		up.SetDeadline(time.Now().Add(Timeout))
+		if err := writeTCPMessage(up, query); err != nil {
+			log.Printf("failed to forward dns query: %s", err)
+			return
+		}
+		resp, err := readTCPMessage(up)
+		if err != nil {
+			log.Printf("failed to read dns response: %s", err)
+			return
+		}
+		s.record(resp)
+		if err := writeTCPMessage(c, resp); err != nil {
+			log.Printf("failed to write dns response: %s", err)
+			return
+		}
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeTCPMessage(w io.Writer, b []byte) error {
+	out := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(out, uint16(len(b)))
+	_, err := w.Write(append(out, b...))
+	return err
+}
@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// fakeAnswer returns 2001:db8::1 for AAAA query, otherwise 192.0.2.1
+func fakeAnswer(q []byte) net.IP {
+	if len(q) >= 4 && binary.BigEndian.Uint16(q[len(q)-4:]) == TypeAAAA {
+		return net.ParseIP("2001:db8::1")
+	}
+	return net.ParseIP("192.0.2.1")
+}
+
+// startFakeUpstream starts dns server answering fakeAnswer for any query
+func startFakeUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buildResponse(buf[:n], fakeAnswer(buf[:n]), 60), raddr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					q, err := readTCPMessage(c)
+					if err != nil {
+						return
+					}
+					writeTCPMessage(c, buildResponse(q, fakeAnswer(q), 60))
+				}
+			}()
+		}
+	}()
+	return addr
+}
+
+func TestServerUDP(t *testing.T) {
+	s := &Server{Upstream: startFakeUpstream(t), Cache: NewCache()}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go s.ServeUDP(pc)
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(buildQuery(1, "udp.example.com"))
+	buf := make([]byte, maxUDPSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 1 || len(m.Answers) != 1 {
+		t.Errorf("invalid response: %+v", m)
+	}
+	if name, ok := s.Cache.Lookup("192.0.2.1"); !ok || name != "udp.example.com" {
+		t.Errorf("not recorded: %s", name)
+	}
+}
+
+func TestServerTCP(t *testing.T) {
+	s := &Server{Upstream: startFakeUpstream(t), Cache: NewCache()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.ServeTCP(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i, name := range []string{"a.example.com", "b.example.com"} {
+		writeTCPMessage(c, buildQuery(uint16(i), name))
+		resp, err := readTCPMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseMessage(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != uint16(i) || m.Question != name {
+			t.Errorf("invalid response: %+v", m)
+		}
+	}
+	if name, ok := s.Cache.Lookup("192.0.2.1"); !ok || name != "b.example.com" {
+		t.Errorf("not recorded: %s", name)
+	}
+}
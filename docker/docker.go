@@ -0,0 +1,219 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DefaultSocket is the default path of docker api socket
+const DefaultSocket = "/var/run/docker.sock"
+
+// BypassLabel is the container label to exclude container from proxy
+const BypassLabel = "traproxy.bypass"
+
+const bridgeNameOption = "com.docker.network.bridge.name"
+
+// Client is docker api client over unix socket
+type Client struct {
+	Socket string
+	http   *http.Client
+}
+
+// NewClient creates docker api client for socket
+func NewClient(socket string) *Client {
+	return &Client{
+		Socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Network represents docker network
+type Network struct {
+	ID      string            `json:"Id"`
+	Name    string            `json:"Name"`
+	Driver  string            `json:"Driver"`
+	Options map[string]string `json:"Options"`
+}
+
+// BridgeName returns name of the bridge interface for network
+func (n *Network) BridgeName() string {
+	if name, ok := n.Options[bridgeNameOption]; ok && name != "" {
+		return name
+	}
+	id := n.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "br-" + id
+}
+
+// Container represents docker container
+type Container struct {
+	ID              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			NetworkID string `json:"NetworkID"`
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// Event represents docker event
+type Event struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Bridge represents bridge network and addresses of containers bypassing proxy
+type Bridge struct {
+	Name     string
+	Bypasses []string
+}
+
+func (c *Client) get(path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	resp, err := c.http.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker api error: GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(path string, query url.Values, v interface{}) error {
+	resp, err := c.get(path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func filters(f map[string][]string) url.Values {
+	b, _ := json.Marshal(f)
+	return url.Values{"filters": {string(b)}}
+}
+
+// Networks returns bridge networks
+func (c *Client) Networks() ([]Network, error) {
+	networks := []Network{}
+	if err := c.getJSON("/networks", filters(map[string][]string{"driver": {"bridge"}}), &networks); err != nil {
+		return nil, fmt.Errorf("failed to list networks: %s", err)
+	}
+	bridges := []Network{}
+	for _, n := range networks {
+		if n.Driver == "bridge" {
+			bridges = append(bridges, n)
+		}
+	}
+	return bridges, nil
+}
+
+// BypassContainers returns running containers labelled to bypass proxy
+func (c *Client) BypassContainers() ([]Container, error) {
+	containers := []Container{}
+	q := filters(map[string][]string{"label": {BypassLabel + "=true"}})
+	if err := c.getJSON("/containers/json", q, &containers); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %s", err)
+	}
+	bypasses := []Container{}
+	for _, ct := range containers {
+		if ct.Labels[BypassLabel] == "true" {
+			bypasses = append(bypasses, ct)
+		}
+	}
+	return bypasses, nil
+}
+
+// Bridges returns bridge networks with addresses of bypass containers
+func (c *Client) Bridges() ([]Bridge, error) {
+	networks, err := c.Networks()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := c.BypassContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	bridges := []Bridge{}
+	for _, n := range networks {
+		b := Bridge{Name: n.BridgeName(), Bypasses: []string{}}
+		for _, ct := range containers {
+			for _, ep := range ct.NetworkSettings.Networks {
+				if ep.NetworkID == n.ID && ep.IPAddress != "" {
+					b.Bypasses = append(b.Bypasses, ep.IPAddress)
+				}
+			}
+		}
+		bridges = append(bridges, b)
+	}
+	return bridges, nil
+}
+
+// IsBridgeChange reports whether the event can change bridges or bypasses
+func (e *Event) IsBridgeChange() bool {
+	switch e.Type {
+	case "network":
+		return e.Action == "create" || e.Action == "destroy" ||
+			e.Action == "connect" || e.Action == "disconnect"
+	case "container":
+		if e.Actor.Attributes[BypassLabel] != "true" {
+			return false
+		}
+		return e.Action == "start" || e.Action == "die"
+	}
+	return false
+}
+
+// Watch calls f for each network and container event until stop is closed
+func (c *Client) Watch(stop <-chan struct{}, f func(Event)) error {
+	resp, err := c.get("/events", filters(map[string][]string{"type": {"network", "container"}}))
+	if err != nil {
+		return fmt.Errorf("failed to watch events: %s", err)
+	}
+	defer resp.Body.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return fmt.Errorf("failed to read event: %s", err)
+		}
+		f(e)
+	}
+}
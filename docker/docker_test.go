@@ -0,0 +1,135 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeDocker struct {
+	ln     net.Listener
+	events chan string
+}
+
+func startFakeDocker(t *testing.T) (*fakeDocker, *Client) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDocker{ln: ln, events: make(chan string, 10)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"Id":"aaaaaaaaaaaaaaaa","Name":"bridge","Driver":"bridge","Options":{"com.docker.network.bridge.name":"docker0"}},
+			{"Id":"bbbbbbbbbbbbbbbb","Name":"mynet","Driver":"bridge","Options":{}},
+			{"Id":"cccccccccccccccc","Name":"host","Driver":"host"}
+		]`)
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"Id":"c1","Labels":{"traproxy.bypass":"true"},"NetworkSettings":{"Networks":{
+				"bridge":{"NetworkID":"aaaaaaaaaaaaaaaa","IPAddress":"172.17.0.2"}}}},
+			{"Id":"c2","Labels":{"traproxy.bypass":"false"},"NetworkSettings":{"Networks":{
+				"bridge":{"NetworkID":"aaaaaaaaaaaaaaaa","IPAddress":"172.17.0.3"}}}}
+		]`)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-f.events:
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	go http.Serve(ln, mux)
+	t.Cleanup(func() { ln.Close() })
+	return f, NewClient(socket)
+}
+
+func TestNetworks(t *testing.T) {
+	_, c := startFakeDocker(t)
+	networks, err := c.Networks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Fatalf("invalid number of networks: %d", len(networks))
+	}
+	if networks[0].BridgeName() != "docker0" {
+		t.Errorf("invalid bridge name: %s", networks[0].BridgeName())
+	}
+	if networks[1].BridgeName() != "br-bbbbbbbbbbbb" {
+		t.Errorf("invalid bridge name: %s", networks[1].BridgeName())
+	}
+}
+
+func TestBridges(t *testing.T) {
+	_, c := startFakeDocker(t)
+	bridges, err := c.Bridges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bridges) != 2 {
+		t.Fatalf("invalid number of bridges: %d", len(bridges))
+	}
+	if len(bridges[0].Bypasses) != 1 || bridges[0].Bypasses[0] != "172.17.0.2" {
+		t.Errorf("invalid bypasses: %v", bridges[0].Bypasses)
+	}
+	if len(bridges[1].Bypasses) != 0 {
+		t.Errorf("invalid bypasses: %v", bridges[1].Bypasses)
+	}
+}
+
+func TestClientNoSocket(t *testing.T) {
+	c := NewClient(filepath.Join(os.TempDir(), "traproxy_no_docker.sock"))
+	if _, err := c.Bridges(); err == nil {
+		t.Error("error not returned")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f, c := startFakeDocker(t)
+	stop := make(chan struct{})
+	got := make(chan Event, 10)
+	errc := make(chan error)
+	go func() {
+		errc <- c.Watch(stop, func(e Event) { got <- e })
+	}()
+
+	f.events <- `{"Type":"network","Action":"create","Actor":{"ID":"n1"}}`
+	f.events <- `{"Type":"container","Action":"start","Actor":{"ID":"c3","Attributes":{"traproxy.bypass":"true"}}}`
+	f.events <- `{"Type":"container","Action":"start","Actor":{"ID":"c4","Attributes":{}}}`
+
+	expected := []bool{true, true, false}
+	for n, want := range expected {
+		select {
+		case e := <-got:
+			if e.IsBridgeChange() != want {
+				t.Errorf("event %d: IsBridgeChange expected=%v", n, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+		}
+	}
+
+	close(stop)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch not stopped")
+	}
+}
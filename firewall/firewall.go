@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nyushi/traproxy/netns"
 )
 
 // FWType represents type of firewall
@@ -17,19 +22,128 @@ const (
 	FWPF
 )
 
+// Mode represents how traffic is redirected to traproxy
+type Mode int
+
+const (
+	// ModeRedirect redirects traffic by nat REDIRECT
+	ModeRedirect Mode = iota
+	// ModeTProxy redirects traffic by mangle TPROXY and policy routing
+	ModeTProxy
+)
+
+// ParseMode returns Mode from string
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "redirect":
+		return ModeRedirect, nil
+	case "tproxy":
+		return ModeTProxy, nil
+	}
+	return ModeRedirect, fmt.Errorf("unknown mode: %s", s)
+}
+
 // Firewall represents firewall operation
 type Firewall interface {
 	Setup() error
 	Teardown() error
 }
 
+// BridgeFirewall is a Firewall which redirects traffic entering from bridges
+type BridgeFirewall interface {
+	Firewall
+	SetBridge(name string, bypasses []string) error
+	RemoveBridge(name string) error
+	Bridges() []string
+}
+
+// DynamicExcludeFirewall is a Firewall whose excluded addresses can be updated at runtime
+type DynamicExcludeFirewall interface {
+	Firewall
+	SetDynamicExcludes(addrs []string) error
+}
+
+// RuleFirewall is a Firewall whose rules can be listed and removed without Setup.
+// bridges are names of bridges and bypassed addresses of BridgeFirewall
+type RuleFirewall interface {
+	Firewall
+	// Rules returns rules set by Setup and SetBridge in order of setup
+	Rules(bridges map[string][]string) ([]CheckRule, error)
+	// Status checks whether each of Rules is installed, followed by
+	// installed rules of traproxy which are not in Rules
+	Status(bridges map[string][]string) ([]RuleStatus, error)
+	// Cleanup removes all installed rules of traproxy
+	Cleanup() error
+}
+
+// RuleStatus is whether rule is installed.
+// Extra rule is installed by traproxy but not in Rules
+type RuleStatus struct {
+	Rule      CheckRule
+	Installed bool
+	Extra     bool
+}
+
 // Config represents configutaion of firewall
 type Config struct {
 	FWType          FWType
+	Mode            Mode
 	ProxyAddr       *string
 	WithNat         bool
+	WithDocker      bool
+	WithDNS         bool
+	DNSUpstream     string
 	ExcludeReserved bool
 	Excludes        []string
+	// DynamicExcludes enables excluding addresses updated at runtime
+	DynamicExcludes bool
+	// Runner runs firewall commands. ExecRunner is used if nil
+	Runner Runner
+	// Netns is path of network namespace where rules are set. Empty is namespace of the process
+	Netns string
+}
+
+func (c *Config) runner() Runner {
+	run := c.Runner
+	if run == nil {
+		run = ExecRunner{}
+	}
+	if c.Netns != "" {
+		return &netnsRunner{path: c.Netns, run: run}
+	}
+	return run
+}
+
+// localAddrs returns local addresses in Netns
+func (c *Config) localAddrs() ([]string, error) {
+	if c.Netns == "" {
+		return LocalAddrs()
+	}
+	var addrs []string
+	err := netns.Do(c.Netns, func() error {
+		var err error
+		addrs, err = LocalAddrs()
+		return err
+	})
+	return addrs, err
+}
+
+// netnsRunner runs commands in network namespace of path
+type netnsRunner struct {
+	path string
+	run  Runner
+}
+
+func (r *netnsRunner) Run(name string, args []string, stdin []byte) ([]byte, error) {
+	var out []byte
+	var err error
+	if nerr := netns.Do(r.path, func() error {
+		out, err = r.run.Run(name, args, stdin)
+		return nil
+	}); nerr != nil {
+		return nil, nerr
+	}
+	return out, err
 }
 
 // ProxyHost return proxy host
@@ -59,7 +173,7 @@ func (c *Config) ExcludeAddrs() ([]string, error) {
 	}
 
 	// exclude local addrs
-	locals, err := LocalAddrs()
+	locals, err := c.localAddrs()
 	if err != nil {
 		return nil, fmt.Errorf("failed to getlocal address: %s", err)
 	}
@@ -71,13 +185,56 @@ func (c *Config) ExcludeAddrs() ([]string, error) {
 	return e, nil
 }
 
+// ExcludeV6Addrs returns ipv6 addresses not to be redirected
+func (c *Config) ExcludeV6Addrs() ([]string, error) {
+	e := []string{}
+	for _, addr := range c.Excludes {
+		if isV6Addr(addr) {
+			e = append(e, addr)
+		}
+	}
+
+	host, err := c.ProxyHost()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy host: %s", err)
+	}
+	if host != nil && isV6Addr(*host) {
+		e = append(e, *host)
+	}
+
+	locals, err := c.localAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to getlocal address: %s", err)
+	}
+	e = append(e, GrepV6Addr(locals)...)
+
+	e = append(e, ReservedV6Addrs()...)
+	return e, nil
+}
+
+func isV6Addr(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		var err error
+		ip, _, err = net.ParseCIDR(addr)
+		if err != nil {
+			return false
+		}
+	}
+	return ip.To4() == nil
+}
+
 // New creates firewall by config
 func New(c *Config) Firewall {
 	switch c.FWType {
 	case FWIPTables:
-		return &iptablesFirewall{c}
+		return &iptablesFirewall{
+			c:        c,
+			bridges:  map[string][]IPTablesRule{},
+			excludes: map[string]bool{},
+		}
 	case FWPF:
-		return &pfFirewall{c}
+		return &pfFirewall{c: c}
 	default:
 		return &nopFirewall{}
 	}
@@ -93,70 +250,532 @@ func (n *nopFirewall) Teardown() error {
 	return nil
 }
 
+var errFirewallClosed = errors.New("firewall is torn down")
+
 type iptablesFirewall struct {
 	c *Config
+
+	mu       sync.Mutex
+	bridges  map[string][]IPTablesRule
+	excludes map[string]bool
+	// applied is rules added by Setup
+	applied []Rule
+	// closed is true from Teardown until next Setup. bridges and excludes are not changed
+	closed bool
 }
 
+// Setup adds rules. If a rule fails, rules added before are rolled back
 func (i *iptablesFirewall) Setup() error {
-	return i.do(true)
+	rules, err := i.rules()
+	if err != nil {
+		return fmt.Errorf("failed to get rules: %s", err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.applied != nil {
+		return errors.New("firewall is already set up")
+	}
+	if err := addRules(i.c.runner(), rules); err != nil {
+		return fmt.Errorf("failed to setup firewall: %s", err)
+	}
+	i.applied = rules
+	i.closed = false
+	return nil
 }
 
+// Teardown deletes rules of bridges and rules added by Setup.
+// SetBridge and SetDynamicExcludes fail after Teardown is started
 func (i *iptablesFirewall) Teardown() error {
-	return i.do(false)
+	i.mu.Lock()
+	i.closed = true
+	i.mu.Unlock()
+	errs := []string{}
+	for _, name := range i.Bridges() {
+		if err := i.RemoveBridge(name); err != nil {
+			errs = append(errs, fmt.Sprintf("bridge %s: %s", name, err))
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := delRules(i.c.runner(), i.applied); err != nil {
+		errs = append(errs, err.Error())
+	}
+	i.applied = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to teardown firewall: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Rules returns rules of Setup followed by rules of bridges
+func (i *iptablesFirewall) Rules(bridges map[string][]string) ([]CheckRule, error) {
+	rules, err := i.allRules(bridges)
+	if err != nil {
+		return nil, err
+	}
+	crs := []CheckRule{}
+	for _, r := range rules {
+		crs = append(crs, r)
+	}
+	return crs, nil
 }
 
-func (i *iptablesFirewall) do(add bool) error {
+// Cleanup deletes rules tagged by RuleComment, then other installed rules
+// of Setup in reverse order
+func (i *iptablesFirewall) Cleanup() error {
 	rules, err := i.rules()
 	if err != nil {
 		return fmt.Errorf("failed to get rules: %s", err)
 	}
+	tagged, err := InstalledIPTablesRules(i.c.runner(), i.c.Mode == ModeTProxy)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %s", err)
+	}
 	var failed bool
+	for n := len(tagged) - 1; n >= 0; n-- {
+		r := tagged[n]
+		log.Printf("-D %s\n", r.GetCommandStr())
+		if err := r.Del(i.c.runner()); err != nil {
+			log.Printf("failed to delete rule: %s", err)
+			failed = true
+		}
+	}
+	for n := len(rules) - 1; n >= 0; n-- {
+		r := rules[n]
+		if isIPTablesRule(r) {
+			continue
+		}
+		ok, err := r.Check(i.c.runner())
+		if err != nil {
+			log.Printf("failed to check rule: %s", err)
+			failed = true
+			continue
+		}
+		if !ok {
+			continue
+		}
+		log.Printf("-D %s\n", r.GetCommandStr())
+		if err := r.Del(i.c.runner()); err != nil {
+			log.Printf("failed to delete rule: %s", err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("failed to cleanup firewall")
+	}
+	return nil
+}
+
+// Status checks rules of Setup and bridges. iptables rules are found by RuleComment
+func (i *iptablesFirewall) Status(bridges map[string][]string) ([]RuleStatus, error) {
+	rules, err := i.allRules(bridges)
+	if err != nil {
+		return nil, err
+	}
+	tagged, err := InstalledIPTablesRules(i.c.runner(), i.c.Mode == ModeTProxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %s", err)
+	}
+	installed := map[string]bool{}
+	for _, r := range tagged {
+		installed[r.GetCommandStr()] = true
+	}
+	expected := map[string]bool{}
+	st := []RuleStatus{}
 	for _, r := range rules {
-		var err error
-		if add {
-			log.Printf("-A %s\n", r.GetCommandStr())
-			err = r.Add()
-		} else {
-			log.Printf("-D %s\n", r.GetCommandStr())
-			err = r.Del()
+		if isIPTablesRule(r) {
+			expected[r.GetCommandStr()] = true
+			st = append(st, RuleStatus{Rule: r, Installed: installed[r.GetCommandStr()]})
+			continue
+		}
+		ok, err := r.Check(i.c.runner())
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %s", r.GetCommandStr(), err)
+		}
+		st = append(st, RuleStatus{Rule: r, Installed: ok})
+	}
+	for _, r := range tagged {
+		if !expected[r.GetCommandStr()] {
+			st = append(st, RuleStatus{Rule: r, Installed: true, Extra: true})
 		}
+	}
+	return st, nil
+}
+
+// isIPTablesRule reports whether r is iptables or ip6tables rule
+func isIPTablesRule(r Rule) bool {
+	switch r.(type) {
+	case IPTablesRule, IP6TablesRule:
+		return true
+	}
+	return false
+}
+
+// allRules returns rules of Setup followed by rules of bridges sorted by name
+func (i *iptablesFirewall) allRules(bridges map[string][]string) ([]Rule, error) {
+	rules, err := i.rules()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules: %s", err)
+	}
+	names := []string{}
+	for name := range bridges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		brules, err := i.bridgeRules(name, bridges[name])
 		if err != nil {
-			log.Printf("failed to execute iptables command: %s", err)
+			return nil, err
+		}
+		rules = append(rules, iptablesRules(brules)...)
+	}
+	return rules, nil
+}
+
+func (i *iptablesFirewall) bridgeRules(name string, bypasses []string) ([]IPTablesRule, error) {
+	e, err := i.c.ExcludeAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exclude addrs: %s", err)
+	}
+	rules := GetRedirectIPTablesBridgeRules(name, e, bypasses)
+	if i.c.WithDNS {
+		rules = append(rules, GetRedirectIPTablesBridgeDNSRules(name)...)
+	}
+	return rules, nil
+}
+
+// SetBridge installs redirect rules for traffic entering from bridge
+func (i *iptablesFirewall) SetBridge(name string, bypasses []string) error {
+	rules, err := i.bridgeRules(name, bypasses)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return errFirewallClosed
+	}
+	if old, ok := i.bridges[name]; ok {
+		if equalRules(old, rules) {
+			return nil
+		}
+		delete(i.bridges, name)
+		if err := delRules(i.c.runner(), iptablesRules(old)); err != nil {
+			return err
+		}
+	}
+	if err := addRules(i.c.runner(), iptablesRules(rules)); err != nil {
+		return err
+	}
+	i.bridges[name] = rules
+	return nil
+}
+
+// RemoveBridge removes redirect rules for bridge
+func (i *iptablesFirewall) RemoveBridge(name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	rules, ok := i.bridges[name]
+	if !ok {
+		return nil
+	}
+	delete(i.bridges, name)
+	return delRules(i.c.runner(), iptablesRules(rules))
+}
+
+// Bridges returns names of bridges which have redirect rules
+func (i *iptablesFirewall) Bridges() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	names := []string{}
+	for name := range i.bridges {
+		names = append(names, name)
+	}
+	return names
+}
+
+// SetDynamicExcludes updates addresses in exclude ipset
+func (i *iptablesFirewall) SetDynamicExcludes(addrs []string) error {
+	if !i.c.DynamicExcludes {
+		return errors.New("dynamic excludes is not enabled")
+	}
+	next := map[string]bool{}
+	for _, addr := range addrs {
+		// ipv6 is redirected only in tproxy mode
+		if !isV6Addr(addr) || i.c.Mode == ModeTProxy {
+			next[addr] = true
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return errFirewallClosed
+	}
+	var failed bool
+	for addr := range next {
+		if i.excludes[addr] {
+			continue
+		}
+		set := excludeSet(addr)
+		log.Printf("add %s to %s", addr, set)
+		if err := set.AddEntry(i.c.runner(), addr); err != nil {
+			log.Printf("failed to add %s to %s: %s", addr, set, err)
+			failed = true
+			continue
+		}
+		i.excludes[addr] = true
+	}
+	for addr := range i.excludes {
+		if next[addr] {
+			continue
+		}
+		set := excludeSet(addr)
+		log.Printf("del %s from %s", addr, set)
+		if err := set.DelEntry(i.c.runner(), addr); err != nil {
+			log.Printf("failed to delete %s from %s: %s", addr, set, err)
 			failed = true
+			continue
 		}
+		delete(i.excludes, addr)
 	}
 	if failed {
-		return errors.New("failed to setup firewall")
+		return errors.New("failed to update exclude set")
+	}
+	return nil
+}
+
+// entrySet is ipset which entries are changed at runtime
+type entrySet interface {
+	AddEntry(run Runner, addr string) error
+	DelEntry(run Runner, addr string) error
+}
+
+// excludeSet returns exclude ipset for family of addr
+func excludeSet(addr string) entrySet {
+	if isV6Addr(addr) {
+		return IP6Set(ExcludeSet6Name)
+	}
+	return IPSet(ExcludeSetName)
+}
+
+func equalRules(a, b []IPTablesRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n].GetCommandStr() != b[n].GetCommandStr() {
+			return false
+		}
+	}
+	return true
+}
+
+func iptablesRules(rules []IPTablesRule) []Rule {
+	rs := []Rule{}
+	for _, r := range rules {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// addRules adds rules in order. If a rule fails, rules added before are deleted in reverse order
+func addRules(run Runner, rules []Rule) error {
+	for n, r := range rules {
+		log.Printf("-A %s\n", r.GetCommandStr())
+		if err := r.Add(run); err != nil {
+			if rerr := delRules(run, rules[:n]); rerr != nil {
+				return fmt.Errorf("%s; rollback: %s", err, rerr)
+			}
+			return err
+		}
 	}
 	return nil
+}
 
+// delRules deletes rules in reverse order. Rules after failed one are also deleted
+func delRules(run Runner, rules []Rule) error {
+	errs := []string{}
+	for n := len(rules) - 1; n >= 0; n-- {
+		r := rules[n]
+		log.Printf("-D %s\n", r.GetCommandStr())
+		if err := r.Del(run); err != nil {
+			log.Printf("failed to delete rule: %s", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete %d rules: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
 }
-func (i *iptablesFirewall) rules() ([]IPTablesRule, error) {
+
+// rules returns rules in the order of setup. teardown uses reverse order.
+func (i *iptablesFirewall) rules() ([]Rule, error) {
 	e, err := i.c.ExcludeAddrs()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get exclude addrs: %s", err)
 	}
-	rules := GetRedirectIPTablesRules(e)
+	dnsRules, err := i.dnsRules()
+	if err != nil {
+		return nil, err
+	}
+	setRules := []Rule{}
+	if i.c.DynamicExcludes {
+		setRules = append(setRules, IPSet(ExcludeSetName))
+		switch {
+		case i.c.Mode == ModeTProxy:
+			setRules = append(setRules, iptablesRules(GetTProxyExcludeSetIPTablesRules(ExcludeSetName))...)
+			setRules = append(setRules, IP6Set(ExcludeSet6Name))
+			for _, r := range GetTProxyExcludeSetIP6TablesRules(ExcludeSet6Name) {
+				setRules = append(setRules, r)
+			}
+		case i.c.WithDocker:
+			setRules = append(setRules, iptablesRules(GetExcludeSetIPTablesNATRules(ExcludeSetName))...)
+		default:
+			setRules = append(setRules, iptablesRules(GetExcludeSetIPTablesRules(ExcludeSetName, i.c.WithNat))...)
+		}
+	}
+	if i.c.Mode == ModeTProxy {
+		if i.c.WithDocker {
+			return nil, errors.New("tproxy mode does not support docker")
+		}
+		rules, err := i.tproxyRules(e)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(setRules, rules...)
+		return append(rules, iptablesRules(dnsRules)...), nil
+	}
+	rules := []IPTablesRule{}
+	if !i.c.WithDocker {
+		// traffic of docker mode is redirected only by rules of bridges
+		rules = append(rules, GetRedirectIPTablesRules(e)...)
+		if i.c.WithNat {
+			rules = append(rules, GetRedirectIPTablesNATRules(e)...)
+		}
+	}
+	rules = append(rules, dnsRules...)
+	return append(setRules, iptablesRules(rules)...), nil
+}
+
+func (i *iptablesFirewall) dnsRules() ([]IPTablesRule, error) {
+	if !i.c.WithDNS || i.c.WithDocker {
+		// dns of docker mode is redirected by rules of bridges
+		return []IPTablesRule{}, nil
+	}
+	host, _, err := net.SplitHostPort(i.c.DNSUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns upstream: %s", err)
+	}
+	rules := GetRedirectIPTablesDNSRules(host)
 	if i.c.WithNat {
-		rules = append(rules, GetRedirectIPTablesNATRules(e)...)
+		rules = append(rules, GetRedirectIPTablesDNSNATRules()...)
+	}
+	return rules, nil
+}
+
+func (i *iptablesFirewall) tproxyRules(e []string) ([]Rule, error) {
+	e6, err := i.c.ExcludeV6Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exclude v6 addrs: %s", err)
+	}
+	rules := []Rule{}
+	for _, r := range GetTProxyRouteRules() {
+		rules = append(rules, r)
+	}
+	e4 := []string{}
+	for _, addr := range e {
+		if !isV6Addr(addr) {
+			e4 = append(e4, addr)
+		}
+	}
+	rules = append(rules, iptablesRules(GetTProxyIPTablesRules(e4))...)
+	for _, r := range GetTProxyIP6TablesRules(e6) {
+		rules = append(rules, r)
 	}
 	return rules, nil
 }
 
 type pfFirewall struct {
 	c *Config
+
+	mu sync.Mutex
+	// token is reference of pf enabled by Setup
+	token string
 }
 
+// Setup loads rules into PFAnchor and enables pf
 func (p *pfFirewall) Setup() error {
 	excludes, err := p.c.ExcludeAddrs()
 	if err != nil {
 		return fmt.Errorf("failed to get exclude addrs: %s", err)
 	}
-	return SetPFRule(excludes)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" {
+		return errors.New("firewall is already set up")
+	}
+	token, err := SetPFRule(p.c.runner(), excludes)
+	if err != nil {
+		return fmt.Errorf("failed to setup firewall: %s", err)
+	}
+	p.token = token
+	return nil
 }
 
+// Teardown flushes PFAnchor and releases pf enabled by Setup
 func (p *pfFirewall) Teardown() error {
-	return ResetPFRule()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token == "" {
+		return nil
+	}
+	if err := ResetPFRule(p.c.runner(), p.token); err != nil {
+		return fmt.Errorf("failed to teardown firewall: %s", err)
+	}
+	p.token = ""
+	return nil
+}
+
+// Rules returns pf rules. pf does not support bridges
+func (p *pfFirewall) Rules(bridges map[string][]string) ([]CheckRule, error) {
+	excludes, err := p.c.ExcludeAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exclude addrs: %s", err)
+	}
+	rules := []CheckRule{}
+	for _, r := range GetPFRules(excludes) {
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Status checks whether pf rules are loaded in PFAnchor, followed by other rules in PFAnchor
+func (p *pfFirewall) Status(bridges map[string][]string) ([]RuleStatus, error) {
+	excludes, err := p.c.ExcludeAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exclude addrs: %s", err)
+	}
+	shown, err := showPFAnchor(p.c.runner())
+	if err != nil {
+		return nil, err
+	}
+	rules := GetPFRules(excludes)
+	st := []RuleStatus{}
+	for _, r := range rules {
+		st = append(st, RuleStatus{Rule: r, Installed: r.loaded(shown)})
+	}
+	for _, r := range extraPFRules(rules, shown) {
+		st = append(st, RuleStatus{Rule: r, Installed: true, Extra: true})
+	}
+	return st, nil
+}
+
+// Cleanup flushes PFAnchor. pf enabled by crashed process is left enabled
+func (p *pfFirewall) Cleanup() error {
+	return flushPFAnchor(p.c.runner())
 }
 
 // LocalAddrs returns assigned local address
@@ -188,6 +807,33 @@ func GrepV4Addr(addrs []string) []string {
 	return v4addrs
 }
 
+// GrepV6Addr returns only ip v6 address
+func GrepV6Addr(addrs []string) []string {
+	v6addrs := []string{}
+	for _, v := range addrs {
+		ip, _, err := net.ParseCIDR(v)
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			continue
+		}
+		v6addrs = append(v6addrs, v)
+	}
+	return v6addrs
+}
+
+// ReservedV6Addrs returns reserved ipv6 addresses
+func ReservedV6Addrs() (addrs []string) {
+	return []string{
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	}
+}
+
 // ReservedV4Addrs returns reserved ipv4 addresses
 func ReservedV4Addrs() (addrs []string) {
 	return []string{
@@ -1,6 +1,11 @@
 package firewall
 
-import "testing"
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func TestLocalNetworks(t *testing.T) {
 	_, err := LocalAddrs()
@@ -23,3 +28,420 @@ func TestGrepV4Addr(t *testing.T) {
 	}
 
 }
+
+func TestGrepV6Addr(t *testing.T) {
+	addrs := []string{"127.0.0.1/16", "", "fe80::1/64", "192.168.0.1/24"}
+	v6addrs := GrepV6Addr(addrs)
+	if len(v6addrs) != 1 || v6addrs[0] != "fe80::1/64" {
+		t.Errorf("invalid v6addrs: %v", v6addrs)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	if m, err := ParseMode("redirect"); err != nil || m != ModeRedirect {
+		t.Error("failed to parse redirect")
+	}
+	if m, err := ParseMode("tproxy"); err != nil || m != ModeTProxy {
+		t.Error("failed to parse tproxy")
+	}
+	if _, err := ParseMode("xxx"); err == nil {
+		t.Error("error not returned")
+	}
+}
+
+// newRecordFirewall returns iptables firewall recording commands
+func newRecordFirewall(c *Config) (Firewall, *RecordRunner) {
+	r := &RecordRunner{}
+	proxy := "192.0.2.10:3128"
+	c.FWType = FWIPTables
+	c.ProxyAddr = &proxy
+	c.Runner = r
+	return New(c), r
+}
+
+// reversed returns lines in reverse order with action replaced
+func reversed(lines []string, from, to string) []string {
+	rev := []string{}
+	for n := len(lines) - 1; n >= 0; n-- {
+		rev = append(rev, strings.Replace(lines[n], from, to, 1))
+	}
+	return rev
+}
+
+func equalLines(t *testing.T, got, expected []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestIPTablesFirewallSetupTeardown(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{WithNat: true})
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	setup := r.Lines()
+	for _, l := range setup {
+		if !strings.HasPrefix(l, "iptables -A ") {
+			t.Errorf("unexpected command: %s", l)
+		}
+	}
+	if !strings.Contains(strings.Join(setup, "\n"), tagged("iptables -A OUTPUT -t nat -p tcp -j ACCEPT -d 192.0.2.10")+"\n") {
+		t.Errorf("proxy is not excluded: %v", setup)
+	}
+	if got := setup[len(setup)-1]; got != tagged("iptables -A PREROUTING -t nat -p tcp -j REDIRECT --dport 443 --to-ports 10080") {
+		t.Errorf("last rule is %s", got)
+	}
+
+	r.Reset()
+	if err := fw.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), reversed(setup, "-A", "-D"))
+
+	// rules are not changed by teardown
+	r.Reset()
+	fw.Setup()
+	equalLines(t, r.Lines(), setup)
+}
+
+func TestIPTablesFirewallSetupFailure(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{})
+	r.Handle = func(c Command) ([]byte, error) {
+		if c.Args[0] == "-A" && strings.Contains(c.String(), "--dport 443 ") {
+			return []byte("iptables: No chain/target/match by that name.\n"), &ExitError{Code: 1}
+		}
+		return nil, nil
+	}
+	err := fw.Setup()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if !strings.Contains(err.Error(), "--dport 443 --to-ports 10080: exit status 1: iptables: No chain/target/match by that name.") {
+		t.Errorf("err=%v", err)
+	}
+
+	// added rules are rolled back in reverse order
+	lines := r.Lines()
+	failed := 0
+	for n, l := range lines {
+		if strings.Contains(l, "--dport 443 ") {
+			failed = n
+			break
+		}
+	}
+	equalLines(t, lines[failed+1:], reversed(lines[:failed], "-A", "-D"))
+
+	// nothing is deleted by teardown
+	r.Reset()
+	if err := fw.Teardown(); err != nil {
+		t.Error(err)
+	}
+	equalLines(t, r.Lines(), []string{})
+
+	// setup can be retried
+	r.Handle = nil
+	if err := fw.Setup(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIPTablesFirewallRollbackFailure(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{})
+	r.Handle = func(c Command) ([]byte, error) {
+		if strings.Contains(c.String(), "--dport 443 ") {
+			return []byte("iptables: No chain/target/match by that name."), &ExitError{Code: 1}
+		}
+		if c.Args[0] == "-D" && strings.Contains(c.String(), "-d 192.0.2.10") {
+			return []byte("iptables: Resource temporarily unavailable."), &ExitError{Code: 4}
+		}
+		return nil, nil
+	}
+	err := fw.Setup()
+	if err == nil || !strings.Contains(err.Error(), "rollback: failed to delete 1 rules: "+tagged("iptables -D OUTPUT -t nat -p tcp -j ACCEPT -d 192.0.2.10")+": exit status 4: iptables: Resource temporarily unavailable.") {
+		t.Errorf("err=%v", err)
+	}
+	// other rules are deleted
+	added, deleted := 0, 0
+	for _, c := range r.Commands() {
+		switch c.Args[0] {
+		case "-A":
+			added++
+		case "-D":
+			deleted++
+		}
+	}
+	if deleted != added-1 {
+		t.Errorf("added=%d deleted=%d", added, deleted)
+	}
+}
+
+func TestIPTablesFirewallSetupTwice(t *testing.T) {
+	fw, _ := newRecordFirewall(&Config{})
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Setup(); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestIPTablesFirewallTProxy(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{Mode: ModeTProxy, DynamicExcludes: true})
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	setup := r.Lines()
+	equalLines(t, setup[:8], []string{
+		"ipset create traproxy-exclude hash:net -exist",
+		tagged("iptables -A PREROUTING -t mangle -p tcp -m set --match-set traproxy-exclude dst -j RETURN"),
+		"ipset create traproxy-exclude6 hash:net family inet6 -exist",
+		tagged("ip6tables -A PREROUTING -t mangle -p tcp -m set --match-set traproxy-exclude6 dst -j RETURN"),
+		"ip rule add fwmark 0x1/0x1 lookup 100",
+		"ip route add local 0.0.0.0/0 dev lo table 100",
+		"ip -6 rule add fwmark 0x1/0x1 lookup 100",
+		"ip -6 route add local ::/0 dev lo table 100",
+	})
+	if got := setup[len(setup)-1]; !strings.HasPrefix(got, "ip6tables -A PREROUTING -t mangle -p tcp -j TPROXY --dport 443") {
+		t.Errorf("last rule is %s", got)
+	}
+
+	r.Reset()
+	fw.Teardown()
+	teardown := r.Lines()
+	if teardown[0] != strings.Replace(setup[len(setup)-1], "-A", "-D", 1) {
+		t.Errorf("first rule is %s", teardown[0])
+	}
+	equalLines(t, teardown[len(teardown)-5:], []string{
+		"ip rule del fwmark 0x1/0x1 lookup 100",
+		tagged("ip6tables -D PREROUTING -t mangle -p tcp -m set --match-set traproxy-exclude6 dst -j RETURN"),
+		"ipset destroy traproxy-exclude6",
+		tagged("iptables -D PREROUTING -t mangle -p tcp -m set --match-set traproxy-exclude dst -j RETURN"),
+		"ipset destroy traproxy-exclude",
+	})
+}
+
+func TestIPTablesFirewallTProxyDocker(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{Mode: ModeTProxy, WithDocker: true})
+	if err := fw.Setup(); err == nil {
+		t.Error("no error")
+	}
+	equalLines(t, r.Lines(), []string{})
+}
+
+func TestIPTablesFirewallDynamicExcludes(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{DynamicExcludes: true})
+	dfw := fw.(DynamicExcludeFirewall)
+	if err := dfw.SetDynamicExcludes([]string{"192.0.2.1", "2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dfw.SetDynamicExcludes([]string{"192.0.2.2"}); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), []string{
+		"ipset add traproxy-exclude 192.0.2.1 -exist",
+		"ipset add traproxy-exclude 192.0.2.2 -exist",
+		"ipset del traproxy-exclude 192.0.2.1 -exist",
+	})
+}
+
+func TestIPTablesFirewallTProxyDynamicExcludes(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{Mode: ModeTProxy, DynamicExcludes: true})
+	dfw := fw.(DynamicExcludeFirewall)
+	if err := dfw.SetDynamicExcludes([]string{"2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dfw.SetDynamicExcludes([]string{"192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), []string{
+		"ipset add traproxy-exclude6 2001:db8::1 -exist",
+		"ipset add traproxy-exclude 192.0.2.1 -exist",
+		"ipset del traproxy-exclude6 2001:db8::1 -exist",
+	})
+}
+
+func TestIPTablesFirewallBridge(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{WithDocker: true})
+	bfw := fw.(BridgeFirewall)
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	setup := r.Lines()
+	r.Reset()
+	if err := bfw.SetBridge("docker0", []string{"172.17.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	bridge := r.Lines()
+	if bridge[0] != tagged("iptables -A PREROUTING -t nat -i docker0 -p tcp -j ACCEPT -s 172.17.0.2") {
+		t.Errorf("first rule is %s", bridge[0])
+	}
+
+	// same rules are not changed
+	r.Reset()
+	bfw.SetBridge("docker0", []string{"172.17.0.2"})
+	if len(r.Lines()) != 0 {
+		t.Errorf("rules are changed: %v", r.Lines())
+	}
+
+	// bridge rules are removed first
+	r.Reset()
+	fw.Teardown()
+	equalLines(t, r.Lines(), append(reversed(bridge, "-A", "-D"), reversed(setup, "-A", "-D")...))
+	if len(bfw.Bridges()) != 0 {
+		t.Errorf("bridges=%v", bfw.Bridges())
+	}
+}
+
+func TestIPTablesFirewallDocker(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{
+		WithNat:         true,
+		WithDocker:      true,
+		WithDNS:         true,
+		DNSUpstream:     "192.0.2.53:53",
+		DynamicExcludes: true,
+	})
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.(BridgeFirewall).SetBridge("docker0", nil); err != nil {
+		t.Fatal(err)
+	}
+	var redirects int
+	for _, l := range r.Lines() {
+		if strings.Contains(l, " OUTPUT ") {
+			t.Errorf("traffic of host is redirected: %s", l)
+		}
+		if strings.Contains(l, "REDIRECT") {
+			redirects++
+			if !strings.Contains(l, " -i docker0 ") {
+				t.Errorf("traffic not from bridge is redirected: %s", l)
+			}
+		}
+	}
+	if redirects != 4 {
+		t.Errorf("redirect rules=%d %v", redirects, r.Lines())
+	}
+}
+
+func TestIPTablesFirewallClosed(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{WithDocker: true, DynamicExcludes: true})
+	bfw := fw.(BridgeFirewall)
+	dfw := fw.(DynamicExcludeFirewall)
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rules are not added by events after teardown
+	r.Reset()
+	if err := bfw.SetBridge("docker0", nil); err == nil {
+		t.Error("bridge is set after teardown")
+	}
+	if err := dfw.SetDynamicExcludes([]string{"192.0.2.1"}); err == nil {
+		t.Error("excludes are set after teardown")
+	}
+	equalLines(t, r.Lines(), []string{})
+
+	// rules can be set after next setup
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bfw.SetBridge("docker0", nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIPTablesFirewallBridgeFailure(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{WithDocker: true})
+	bfw := fw.(BridgeFirewall)
+	r.Handle = func(c Command) ([]byte, error) {
+		if strings.Contains(c.String(), "-A PREROUTING -t nat -i docker0 -p tcp -j REDIRECT") {
+			return []byte("iptables: No chain/target/match by that name."), &ExitError{Code: 1}
+		}
+		return nil, nil
+	}
+	if err := bfw.SetBridge("docker0", nil); err == nil {
+		t.Fatal("no error")
+	}
+	if len(bfw.Bridges()) != 0 {
+		t.Errorf("bridges=%v", bfw.Bridges())
+	}
+	r.Reset()
+	fw.Teardown()
+	equalLines(t, r.Lines(), []string{})
+}
+
+func TestIPTablesFirewallStatusCleanup(t *testing.T) {
+	fw, r := newRecordFirewall(&Config{})
+	rfw := fw.(RuleFirewall)
+	rules, err := rfw.Rules(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rule of address removed after setup is left, and rule of other program is not changed
+	r.Handle = func(c Command) ([]byte, error) {
+		if c.String() == "iptables -t nat -S" {
+			return []byte(`-P PREROUTING ACCEPT
+-P OUTPUT ACCEPT
+-N DOCKER
+-A OUTPUT -d 192.0.2.99/32 -p tcp -m comment --comment "traproxy: OUTPUT -t nat -p tcp -j ACCEPT -d 192.0.2.99" -j ACCEPT
+-A OUTPUT -p tcp -m tcp --dport 443 -m comment --comment "traproxy: OUTPUT -t nat -p tcp -j REDIRECT --dport 443 --to-ports 10080" -j REDIRECT --to-ports 10080
+-A OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -m comment --comment docker -j DOCKER
+`), nil
+		}
+		return nil, nil
+	}
+	st, err := rfw.Status(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != len(rules)+1 || st[0].Installed || !st[len(rules)-1].Installed || st[len(rules)-1].Extra {
+		t.Errorf("status=%v", st)
+	}
+	if extra := st[len(st)-1]; !extra.Extra || extra.Rule.GetCommandStr() != "iptables OUTPUT -t nat -p tcp -j ACCEPT -d 192.0.2.99" {
+		t.Errorf("extra=%v", extra)
+	}
+	equalLines(t, r.Lines(), []string{"iptables -t nat -S", "iptables -t mangle -S"})
+
+	r.Reset()
+	if err := rfw.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), []string{
+		"iptables -t nat -S",
+		"iptables -t mangle -S",
+		tagged("iptables -D OUTPUT -t nat -p tcp -j REDIRECT --dport 443 --to-ports 10080"),
+		tagged("iptables -D OUTPUT -t nat -p tcp -j ACCEPT -d 192.0.2.99"),
+	})
+
+	r.Handle = func(c Command) ([]byte, error) {
+		return []byte("iptables: Permission denied"), &ExitError{Code: 4}
+	}
+	if _, err := rfw.Status(nil); err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestIPTablesFirewallNetns(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Getuid() != 0 {
+		t.Skip("requires root on linux")
+	}
+	fw, r := newRecordFirewall(&Config{Netns: "/proc/self/ns/net"})
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Lines()) == 0 {
+		t.Error("no commands run in namespace")
+	}
+
+	fw, r = newRecordFirewall(&Config{Netns: "/nonexistent"})
+	if err := fw.Setup(); err == nil || !strings.Contains(err.Error(), "network namespace") {
+		t.Errorf("err=%v", err)
+	}
+	if lines := r.Lines(); len(lines) != 0 {
+		t.Errorf("commands run outside namespace: %v", lines)
+	}
+}
@@ -0,0 +1,86 @@
+package firewall
+
+import (
+	"strings"
+)
+
+// ExcludeSetName is name of ipset for addresses excluded at runtime
+const ExcludeSetName = "traproxy-exclude"
+
+// ExcludeSet6Name is name of ipset for ipv6 addresses excluded at runtime
+const ExcludeSet6Name = "traproxy-exclude6"
+
+// IPSet represents ipset of networks.
+// Add and Del creates and destroys the set
+type IPSet string
+
+func (s IPSet) createArgs() []string {
+	return []string{"create", string(s), "hash:net", "-exist"}
+}
+
+// Add creates ipset
+func (s IPSet) Add(run Runner) error {
+	return execCommand(run, "ipset", s.createArgs())
+}
+
+// Del destroys ipset
+func (s IPSet) Del(run Runner) error {
+	return execCommand(run, "ipset", []string{"destroy", string(s)})
+}
+
+// Check reports whether ipset exists
+func (s IPSet) Check(run Runner) (bool, error) {
+	return checkCommand(run, "ipset", []string{"list", "-n", string(s)})
+}
+
+// GetCommandStr returns commandline string
+func (s IPSet) GetCommandStr() string {
+	return "ipset " + strings.Join(s.createArgs(), " ")
+}
+
+// AddEntry adds addr to ipset
+func (s IPSet) AddEntry(run Runner, addr string) error {
+	return execCommand(run, "ipset", []string{"add", string(s), addr, "-exist"})
+}
+
+// DelEntry deletes addr from ipset
+func (s IPSet) DelEntry(run Runner, addr string) error {
+	return execCommand(run, "ipset", []string{"del", string(s), addr, "-exist"})
+}
+
+// IP6Set represents ipset of ipv6 networks
+type IP6Set string
+
+func (s IP6Set) createArgs() []string {
+	return []string{"create", string(s), "hash:net", "family", "inet6", "-exist"}
+}
+
+// Add creates ipset
+func (s IP6Set) Add(run Runner) error {
+	return execCommand(run, "ipset", s.createArgs())
+}
+
+// Del destroys ipset
+func (s IP6Set) Del(run Runner) error {
+	return IPSet(s).Del(run)
+}
+
+// Check reports whether ipset exists
+func (s IP6Set) Check(run Runner) (bool, error) {
+	return IPSet(s).Check(run)
+}
+
+// GetCommandStr returns commandline string
+func (s IP6Set) GetCommandStr() string {
+	return "ipset " + strings.Join(s.createArgs(), " ")
+}
+
+// AddEntry adds addr to ipset
+func (s IP6Set) AddEntry(run Runner, addr string) error {
+	return IPSet(s).AddEntry(run, addr)
+}
+
+// DelEntry deletes addr from ipset
+func (s IP6Set) DelEntry(run Runner, addr string) error {
+	return IPSet(s).DelEntry(run, addr)
+}
@@ -1,6 +1,8 @@
 package firewall
 
 import (
+	"errors"
+	"fmt"
 	"os/exec"
 	"strings"
 )
@@ -8,37 +10,170 @@ import (
 var (
 	redirect        = "REDIRECT"
 	accept          = "ACCEPT"
+	ret             = "RETURN"
+	tproxy          = "TPROXY"
 	outputChain     = "OUTPUT"
 	preroutingChain = "PREROUTING"
 )
 
-// IPTablesRule represents iptables rule line
-type IPTablesRule []string
+const (
+	// DNSPort is port of dns listener
+	DNSPort = "10053"
+	// TProxyMark is fwmark for packets redirected by TPROXY
+	TProxyMark = "0x1"
+	// TProxyTable is routing table for packets marked by TPROXY
+	TProxyTable = "100"
+	// RuleComment is prefix of comment tagging iptables rules of traproxy.
+	// The comment has the rule itself to find rules installed by other runs
+	RuleComment = "traproxy:"
+)
+
+// CommandError is error of failed command with its output
+type CommandError struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: %s", e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Command, e.Err, e.Output)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func commandError(name string, args []string, out []byte, err error) error {
+	return &CommandError{
+		Command: strings.Join(append([]string{name}, args...), " "),
+		Output:  strings.TrimSpace(string(out)),
+		Err:     err,
+	}
+}
+
+func execCommand(run Runner, name string, args []string) error {
+	out, err := run.Run(name, args, nil)
+	if err != nil {
+		return commandError(name, args, out, err)
+	}
+	return nil
+}
+
+// exitCode returns exit code of failed command, or -1 if not exited
+func exitCode(err error) int {
+	if e, ok := err.(interface{ ExitCode() int }); ok {
+		return e.ExitCode()
+	}
+	return -1
+}
 
-func (r *IPTablesRule) exec() error {
-	path, err := exec.LookPath("iptables")
+// checkCommand runs command which exits with 1 if rule does not exist
+func checkCommand(run Runner, name string, args []string) (bool, error) {
+	out, err := run.Run(name, args, nil)
+	if err != nil && exitCode(err) == 1 {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, commandError(name, args, out, err)
+	}
+	return true, nil
+}
+
+// CheckRule represents firewall rule whose installation can be checked
+type CheckRule interface {
+	// Check reports whether rule is installed
+	Check(run Runner) (bool, error)
+	GetCommandStr() string
+}
+
+// Rule represents firewall command which can be added and deleted
+type Rule interface {
+	CheckRule
+	Add(run Runner) error
+	Del(run Runner) error
+}
+
+// IPTablesRule represents iptables rule line.
+// Rules are tagged by comment of RuleComment
+type IPTablesRule []string
+
+// tagArgs returns arguments for action of rule with comment tagging rule
+func tagArgs(action string, rule []string) []string {
+	args := append([]string{action}, rule...)
+	return append(args, "-m", "comment", "--comment", RuleComment+" "+strings.Join(rule, " "))
+}
+
+// taggedRule returns rule in comment of line listed by iptables -S,
+// or nil if line is not tagged by RuleComment
+func taggedRule(line string) []string {
+	if !strings.HasPrefix(line, "-A ") {
+		return nil
+	}
+	_, comment, ok := strings.Cut(line, " --comment ")
+	if !ok {
+		return nil
+	}
+	rule, ok := strings.CutPrefix(strings.TrimPrefix(comment, `"`), RuleComment+" ")
+	if !ok {
+		return nil
+	}
+	rule, _, _ = strings.Cut(rule, `"`)
+	return strings.Fields(rule)
+}
+
+// InstalledIPTablesRules returns rules tagged by RuleComment in nat and mangle
+// tables, and in mangle table of ip6tables if v6 is true.
+// Tables of commands not found are skipped
+func InstalledIPTablesRules(run Runner, v6 bool) ([]Rule, error) {
+	tables := [][]string{{"iptables", "nat"}, {"iptables", "mangle"}}
+	if v6 {
+		tables = append(tables, []string{"ip6tables", "mangle"})
 	}
-	_, err = exec.Command(path, *r...).CombinedOutput()
-	return err
+	rules := []Rule{}
+	for _, t := range tables {
+		args := []string{"-t", t[1], "-S"}
+		out, err := run.Run(t[0], args, nil)
+		if errors.Is(err, exec.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, commandError(t[0], args, out, err)
+		}
+		for _, l := range strings.Split(string(out), "\n") {
+			r := taggedRule(l)
+			switch {
+			case r == nil:
+			case t[0] == "ip6tables":
+				rules = append(rules, IP6TablesRule(r))
+			default:
+				rules = append(rules, IPTablesRule(r))
+			}
+		}
+	}
+	return rules, nil
 }
 
 // Add adds iptables rule
-func (r *IPTablesRule) Add() error {
-	*r = append([]string{"-A"}, *r...)
-	return r.exec()
+func (r IPTablesRule) Add(run Runner) error {
+	return execCommand(run, "iptables", tagArgs("-A", r))
 }
 
 // Del deletes iptables rule
-func (r *IPTablesRule) Del() error {
-	*r = append([]string{"-D"}, *r...)
-	return r.exec()
+func (r IPTablesRule) Del(run Runner) error {
+	return execCommand(run, "iptables", tagArgs("-D", r))
+}
+
+// Check checks iptables rule
+func (r IPTablesRule) Check(run Runner) (bool, error) {
+	return checkCommand(run, "iptables", tagArgs("-C", r))
 }
 
 // GetCommandStr returns commandline string
-func (r *IPTablesRule) GetCommandStr() string {
-	return "iptables " + strings.Join(*r, " ")
+func (r IPTablesRule) GetCommandStr() string {
+	return "iptables " + strings.Join(r, " ")
 }
 
 // GetRedirectRules returns iptables rules for redirect
@@ -64,3 +199,198 @@ func GetRedirectIPTablesNATRules(excludes []string) []IPTablesRule {
 	rules = append(rules, []string{preroutingChain, "-t", "nat", "-p", "tcp", "-j", redirect, "--dport", "443", "--to-ports", "10080"})
 	return rules
 }
+
+// GetRedirectIPTablesBridgeRules returns iptables rules for nat from bridge interface
+func GetRedirectIPTablesBridgeRules(bridge string, excludes []string, bypasses []string) []IPTablesRule {
+	rules := []IPTablesRule{}
+	for _, addr := range bypasses {
+		rules = append(rules, []string{preroutingChain, "-t", "nat", "-i", bridge, "-p", "tcp", "-j", accept, "-s", addr})
+	}
+	for _, addr := range excludes {
+		rules = append(rules, []string{preroutingChain, "-t", "nat", "-i", bridge, "-p", "tcp", "-j", accept, "-d", addr})
+	}
+
+	rules = append(rules, []string{preroutingChain, "-t", "nat", "-i", bridge, "-p", "tcp", "-j", redirect, "--dport", "80", "--to-ports", "10080"})
+	rules = append(rules, []string{preroutingChain, "-t", "nat", "-i", bridge, "-p", "tcp", "-j", redirect, "--dport", "443", "--to-ports", "10080"})
+	return rules
+}
+
+// GetExcludeSetIPTablesRules returns iptables rules for excluding addresses in ipset
+func GetExcludeSetIPTablesRules(set string, withNat bool) []IPTablesRule {
+	rules := []IPTablesRule{}
+	rules = append(rules, []string{outputChain, "-t", "nat", "-p", "tcp", "-m", "set", "--match-set", set, "dst", "-j", accept})
+	if withNat {
+		rules = append(rules, GetExcludeSetIPTablesNATRules(set)...)
+	}
+	return rules
+}
+
+// GetExcludeSetIPTablesNATRules returns iptables rules for excluding addresses in ipset from nat
+func GetExcludeSetIPTablesNATRules(set string) []IPTablesRule {
+	return []IPTablesRule{
+		[]string{preroutingChain, "-t", "nat", "-p", "tcp", "-m", "set", "--match-set", set, "dst", "-j", accept},
+	}
+}
+
+// GetTProxyExcludeSetIPTablesRules returns iptables rules for excluding addresses in ipset from tproxy
+func GetTProxyExcludeSetIPTablesRules(set string) []IPTablesRule {
+	return []IPTablesRule{
+		[]string{preroutingChain, "-t", "mangle", "-p", "tcp", "-m", "set", "--match-set", set, "dst", "-j", ret},
+	}
+}
+
+// GetRedirectIPTablesDNSRules returns iptables rules for dns redirect.
+// upstream is excluded not to redirect queries forwarded by traproxy
+func GetRedirectIPTablesDNSRules(upstream string) []IPTablesRule {
+	rules := []IPTablesRule{}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{outputChain, "-t", "nat", "-p", proto, "-j", accept, "-d", upstream, "--dport", "53"})
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{outputChain, "-t", "nat", "-p", proto, "-j", redirect, "--dport", "53", "--to-ports", DNSPort})
+	}
+	return rules
+}
+
+// GetRedirectIPTablesDNSNATRules returns iptables rules for dns redirect with nat
+func GetRedirectIPTablesDNSNATRules() []IPTablesRule {
+	rules := []IPTablesRule{}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{preroutingChain, "-t", "nat", "-p", proto, "-j", redirect, "--dport", "53", "--to-ports", DNSPort})
+	}
+	return rules
+}
+
+// GetRedirectIPTablesBridgeDNSRules returns iptables rules for dns redirect from bridge interface
+func GetRedirectIPTablesBridgeDNSRules(bridge string) []IPTablesRule {
+	rules := []IPTablesRule{}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{preroutingChain, "-t", "nat", "-i", bridge, "-p", proto, "-j", redirect, "--dport", "53", "--to-ports", DNSPort})
+	}
+	return rules
+}
+
+// GetTProxyIPTablesRules returns iptables rules for tproxy
+func GetTProxyIPTablesRules(excludes []string) []IPTablesRule {
+	rules := []IPTablesRule{}
+	for _, addr := range excludes {
+		rules = append(rules, []string{preroutingChain, "-t", "mangle", "-p", "tcp", "-j", ret, "-d", addr})
+	}
+
+	mark := TProxyMark + "/" + TProxyMark
+	rules = append(rules, []string{preroutingChain, "-t", "mangle", "-p", "tcp", "-j", tproxy, "--dport", "80", "--on-port", "10080", "--tproxy-mark", mark})
+	rules = append(rules, []string{preroutingChain, "-t", "mangle", "-p", "tcp", "-j", tproxy, "--dport", "443", "--on-port", "10080", "--tproxy-mark", mark})
+	return rules
+}
+
+// IP6TablesRule represents ip6tables rule line
+type IP6TablesRule []string
+
+// Add adds ip6tables rule
+func (r IP6TablesRule) Add(run Runner) error {
+	return execCommand(run, "ip6tables", tagArgs("-A", r))
+}
+
+// Del deletes ip6tables rule
+func (r IP6TablesRule) Del(run Runner) error {
+	return execCommand(run, "ip6tables", tagArgs("-D", r))
+}
+
+// Check checks ip6tables rule
+func (r IP6TablesRule) Check(run Runner) (bool, error) {
+	return checkCommand(run, "ip6tables", tagArgs("-C", r))
+}
+
+// GetCommandStr returns commandline string
+func (r IP6TablesRule) GetCommandStr() string {
+	return "ip6tables " + strings.Join(r, " ")
+}
+
+// GetTProxyIP6TablesRules returns ip6tables rules for tproxy
+func GetTProxyIP6TablesRules(excludes []string) []IP6TablesRule {
+	rules := []IP6TablesRule{}
+	for _, r := range GetTProxyIPTablesRules(excludes) {
+		rules = append(rules, IP6TablesRule(r))
+	}
+	return rules
+}
+
+// GetTProxyExcludeSetIP6TablesRules returns ip6tables rules for excluding addresses in ipset from tproxy
+func GetTProxyExcludeSetIP6TablesRules(set string) []IP6TablesRule {
+	rules := []IP6TablesRule{}
+	for _, r := range GetTProxyExcludeSetIPTablesRules(set) {
+		rules = append(rules, IP6TablesRule(r))
+	}
+	return rules
+}
+
+// IPRouteRule represents ip rule or ip route line.
+// The first element is object such as "rule" or "route"
+type IPRouteRule []string
+
+func (r IPRouteRule) args(action string) []string {
+	args := []string{}
+	for n, v := range r {
+		args = append(args, v)
+		if !strings.HasPrefix(v, "-") {
+			args = append(args, action)
+			args = append(args, r[n+1:]...)
+			break
+		}
+	}
+	return args
+}
+
+// Add adds routing rule
+func (r IPRouteRule) Add(run Runner) error {
+	return execCommand(run, "ip", r.args("add"))
+}
+
+// Del deletes routing rule
+func (r IPRouteRule) Del(run Runner) error {
+	return execCommand(run, "ip", r.args("del"))
+}
+
+// showArgs returns arguments to show r
+func (r IPRouteRule) showArgs() []string {
+	args := r.args("show")
+	for n := 1; n+1 < len(args); n++ {
+		// route type is selected by type keyword
+		if args[n-1] == "route" && args[n] == "show" && args[n+1] == "local" {
+			shown := append([]string{}, args[:n+1]...)
+			shown = append(shown, "type")
+			return append(shown, args[n+1:]...)
+		}
+	}
+	return args
+}
+
+// Check reports whether routing rule exists
+func (r IPRouteRule) Check(run Runner) (bool, error) {
+	out, err := run.Run("ip", r.showArgs(), nil)
+	if err != nil {
+		if strings.Contains(string(out), "does not exist") {
+			// routing table is not created yet
+			return false, nil
+		}
+		return false, commandError("ip", r.showArgs(), out, err)
+	}
+	return len(strings.TrimSpace(string(out))) > 0, nil
+}
+
+// GetCommandStr returns commandline string
+func (r IPRouteRule) GetCommandStr() string {
+	return "ip " + strings.Join(r, " ")
+}
+
+// GetTProxyRouteRules returns policy routing rules for tproxy
+func GetTProxyRouteRules() []IPRouteRule {
+	// only the bit of TProxyMark is matched as --tproxy-mark sets it
+	mark := TProxyMark + "/" + TProxyMark
+	return []IPRouteRule{
+		{"rule", "fwmark", mark, "lookup", TProxyTable},
+		{"route", "local", "0.0.0.0/0", "dev", "lo", "table", TProxyTable},
+		{"-6", "rule", "fwmark", mark, "lookup", TProxyTable},
+		{"-6", "route", "local", "::/0", "dev", "lo", "table", TProxyTable},
+	}
+}
@@ -1,6 +1,9 @@
 package firewall
 
 import (
+	"errors"
+	"os/exec"
+	"strings"
 	"testing"
 )
 
@@ -15,6 +18,78 @@ func TestIPTablesRule(t *testing.T) {
 	}
 }
 
+func TestIPTablesRuleAddDel(t *testing.T) {
+	r := &RecordRunner{}
+	rule := IPTablesRule{"OUTPUT", "-j", "ACCEPT"}
+	rule.Add(r)
+	rule.Del(r)
+	rule.Check(r)
+	equalLines(t, r.Lines(), []string{
+		"iptables -A OUTPUT -j ACCEPT -m comment --comment traproxy: OUTPUT -j ACCEPT",
+		"iptables -D OUTPUT -j ACCEPT -m comment --comment traproxy: OUTPUT -j ACCEPT",
+		"iptables -C OUTPUT -j ACCEPT -m comment --comment traproxy: OUTPUT -j ACCEPT",
+	})
+	if rule.GetCommandStr() != "iptables OUTPUT -j ACCEPT" {
+		t.Errorf("rule is changed: %s", rule.GetCommandStr())
+	}
+}
+
+// tagged returns command line of iptables with comment added by tagArgs
+func tagged(line string) string {
+	fields := strings.Fields(line)
+	return line + " -m comment --comment " + RuleComment + " " + strings.Join(fields[2:], " ")
+}
+
+func TestInstalledIPTablesRules(t *testing.T) {
+	r := &RecordRunner{Handle: func(c Command) ([]byte, error) {
+		switch c.String() {
+		case "iptables -t mangle -S":
+			return []byte(`# Warning: iptables-legacy tables present, use iptables-legacy to see them
+-P PREROUTING ACCEPT
+-A PREROUTING -p tcp -m comment --comment "traproxy: PREROUTING -t mangle -p tcp -j RETURN -d 10.0.0.0/8" -d 10.0.0.0/8 -j RETURN
+-A PREROUTING -p tcp -m comment --comment "other: PREROUTING" -j RETURN
+`), nil
+		case "ip6tables -t mangle -S":
+			return nil, &exec.Error{Name: "ip6tables", Err: exec.ErrNotFound}
+		}
+		return nil, nil
+	}}
+	rules, err := InstalledIPTablesRules(r, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].GetCommandStr() != "iptables PREROUTING -t mangle -p tcp -j RETURN -d 10.0.0.0/8" {
+		t.Errorf("rules=%v", rules)
+	}
+
+	r.Handle = func(c Command) ([]byte, error) {
+		return []byte("iptables v1.8.7 (legacy): can't initialize iptables table `nat': Permission denied (you must be root)"), &ExitError{Code: 3}
+	}
+	if _, err := InstalledIPTablesRules(r, true); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	var tests = []struct {
+		err       error
+		installed bool
+		failed    bool
+	}{
+		{nil, true, false},
+		{&ExitError{Code: 1}, false, false},
+		{&ExitError{Code: 2}, false, true},
+		{errors.New("not found"), false, true},
+	}
+	for _, v := range tests {
+		r := &RecordRunner{Handle: func(c Command) ([]byte, error) { return nil, v.err }}
+		ok, err := IPSet("test").Check(r)
+		if ok != v.installed || (err != nil) != v.failed {
+			t.Errorf("%v: installed=%t err=%v", v.err, ok, err)
+		}
+	}
+}
+
 func TestGetRedirectRules(t *testing.T) {
 	rules := GetRedirectIPTablesRules([]string{"127.0.0.1/8"})
 	got := ""
@@ -42,3 +117,119 @@ func TestGetRedirectNATRules(t *testing.T) {
 		t.Error(got, expected)
 	}
 }
+
+func TestGetRedirectBridgeRules(t *testing.T) {
+	rules := GetRedirectIPTablesBridgeRules("docker0", []string{"127.0.0.1/8"}, []string{"172.17.0.2"})
+	got := ""
+	expected := "iptables PREROUTING -t nat -i docker0 -p tcp -j ACCEPT -s 172.17.0.2\n"
+	expected += "iptables PREROUTING -t nat -i docker0 -p tcp -j ACCEPT -d 127.0.0.1/8\n"
+	expected += "iptables PREROUTING -t nat -i docker0 -p tcp -j REDIRECT --dport 80 --to-ports 10080\n"
+	expected += "iptables PREROUTING -t nat -i docker0 -p tcp -j REDIRECT --dport 443 --to-ports 10080\n"
+	for _, r := range rules {
+		got += r.GetCommandStr() + "\n"
+	}
+	if got != expected {
+		t.Error(got, expected)
+	}
+}
+
+func TestGetTProxyRules(t *testing.T) {
+	rules := GetTProxyIPTablesRules([]string{"127.0.0.1/8"})
+	got := ""
+	expected := "iptables PREROUTING -t mangle -p tcp -j RETURN -d 127.0.0.1/8\n"
+	expected += "iptables PREROUTING -t mangle -p tcp -j TPROXY --dport 80 --on-port 10080 --tproxy-mark 0x1/0x1\n"
+	expected += "iptables PREROUTING -t mangle -p tcp -j TPROXY --dport 443 --on-port 10080 --tproxy-mark 0x1/0x1\n"
+	for _, r := range rules {
+		got += r.GetCommandStr() + "\n"
+	}
+	if got != expected {
+		t.Error(got, expected)
+	}
+
+	rules6 := GetTProxyIP6TablesRules([]string{"::1/128"})
+	if rules6[0].GetCommandStr() != "ip6tables PREROUTING -t mangle -p tcp -j RETURN -d ::1/128" {
+		t.Error(rules6[0].GetCommandStr())
+	}
+}
+
+func TestIPRouteRuleArgs(t *testing.T) {
+	var tests = []struct {
+		rule     IPRouteRule
+		expected string
+	}{
+		{IPRouteRule{"rule", "fwmark", "0x1/0x1", "lookup", "100"}, "rule del fwmark 0x1/0x1 lookup 100"},
+		{IPRouteRule{"-6", "route", "local", "::/0", "dev", "lo"}, "-6 route del local ::/0 dev lo"},
+	}
+	for _, v := range tests {
+		got := strings.Join(v.rule.args("del"), " ")
+		if got != v.expected {
+			t.Errorf("got=%s, expected=%s", got, v.expected)
+		}
+	}
+}
+
+func TestIPRouteRuleShowArgs(t *testing.T) {
+	var tests = []struct {
+		rule     IPRouteRule
+		expected string
+	}{
+		{IPRouteRule{"rule", "fwmark", "0x1/0x1", "lookup", "100"}, "rule show fwmark 0x1/0x1 lookup 100"},
+		{IPRouteRule{"-6", "route", "local", "::/0", "dev", "lo", "table", "100"}, "-6 route show type local ::/0 dev lo table 100"},
+	}
+	for _, v := range tests {
+		got := strings.Join(v.rule.showArgs(), " ")
+		if got != v.expected {
+			t.Errorf("got=%s, expected=%s", got, v.expected)
+		}
+	}
+}
+
+func TestIPRouteRuleCheck(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip is not found")
+	}
+	// table is not used
+	ok, err := IPRouteRule{"route", "local", "0.0.0.0/0", "dev", "lo", "table", "252"}.Check(ExecRunner{})
+	if ok || err != nil {
+		t.Errorf("ok=%t err=%v", ok, err)
+	}
+}
+
+func TestGetRedirectDNSRules(t *testing.T) {
+	rules := GetRedirectIPTablesDNSRules("192.0.2.53")
+	rules = append(rules, GetRedirectIPTablesDNSNATRules()...)
+	got := ""
+	expected := "iptables OUTPUT -t nat -p udp -j ACCEPT -d 192.0.2.53 --dport 53\n"
+	expected += "iptables OUTPUT -t nat -p tcp -j ACCEPT -d 192.0.2.53 --dport 53\n"
+	expected += "iptables OUTPUT -t nat -p udp -j REDIRECT --dport 53 --to-ports 10053\n"
+	expected += "iptables OUTPUT -t nat -p tcp -j REDIRECT --dport 53 --to-ports 10053\n"
+	expected += "iptables PREROUTING -t nat -p udp -j REDIRECT --dport 53 --to-ports 10053\n"
+	expected += "iptables PREROUTING -t nat -p tcp -j REDIRECT --dport 53 --to-ports 10053\n"
+	for _, r := range rules {
+		got += r.GetCommandStr() + "\n"
+	}
+	if got != expected {
+		t.Error(got, expected)
+	}
+}
+
+func TestGetExcludeSetRules(t *testing.T) {
+	rules := GetExcludeSetIPTablesRules(ExcludeSetName, true)
+	rules = append(rules, GetTProxyExcludeSetIPTablesRules(ExcludeSetName)...)
+	got := ""
+	expected := "iptables OUTPUT -t nat -p tcp -m set --match-set traproxy-exclude dst -j ACCEPT\n"
+	expected += "iptables PREROUTING -t nat -p tcp -m set --match-set traproxy-exclude dst -j ACCEPT\n"
+	expected += "iptables PREROUTING -t mangle -p tcp -m set --match-set traproxy-exclude dst -j RETURN\n"
+	for _, r := range rules {
+		got += r.GetCommandStr() + "\n"
+	}
+	if got != expected {
+		t.Error(got, expected)
+	}
+	if IPSet(ExcludeSetName).GetCommandStr() != "ipset create traproxy-exclude hash:net -exist" {
+		t.Error(IPSet(ExcludeSetName).GetCommandStr())
+	}
+	if IP6Set(ExcludeSet6Name).GetCommandStr() != "ipset create traproxy-exclude6 hash:net family inet6 -exist" {
+		t.Error(IP6Set(ExcludeSet6Name).GetCommandStr())
+	}
+}
@@ -1,10 +1,11 @@
 package firewall
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
+	"net"
+	"regexp"
 	"strings"
 )
 
@@ -12,39 +13,167 @@ var (
 	pfctl = "pfctl"
 )
 
-func SetPFRule(excludeAddrs []string) error {
-	path, err := exec.LookPath(pfctl)
-	if err != nil {
-		return fmt.Errorf("%s not found: %s", pfctl, err)
-	}
-	cmd := exec.Command(path, "-ef", "-")
-	rules := []string{}
+// PFAnchor is pf anchor for traproxy rules.
+// Anchors under com.apple are evaluated by default pf.conf of macOS
+const PFAnchor = "com.apple/traproxy"
+
+// GetPFRules returns pf rules for redirect
+func GetPFRules(excludeAddrs []string) []PFRule {
+	rules := []PFRule{}
 	rules = append(rules, "rdr pass inet proto tcp from any to any port = 80 -> 127.0.0.1 port 10080")
 	rules = append(rules, "rdr pass inet proto tcp from any to any port = 443 -> 127.0.0.1 port 10080")
 	for _, e := range excludeAddrs {
-		rules = append(rules, fmt.Sprintf("pass out quick proto tcp from any to %s", e))
+		rules = append(rules, PFRule(fmt.Sprintf("pass out quick proto tcp from any to %s", e)))
 	}
 	rules = append(rules, "pass out route-to lo0 inet proto tcp from any to any port 80 keep state")
 	rules = append(rules, "pass out route-to lo0 inet proto tcp from any to any port 443 keep state")
-	rulestr := strings.Join(rules, "\n") + "\n"
-	log.Printf("set pf rules:\n%s", rulestr)
-	cmd.Stdin = bytes.NewBuffer([]byte(rulestr))
-	out, err := cmd.CombinedOutput()
+	return rules
+}
+
+// PFRule represents pf rule line. pf rules are loaded into PFAnchor at once by SetPFRule
+type PFRule string
+
+// Check reports whether rule is loaded in PFAnchor
+func (r PFRule) Check(run Runner) (bool, error) {
+	shown, err := showPFAnchor(run)
 	if err != nil {
-		return fmt.Errorf("failed to execute %s:\noutput=%s", pfctl, out)
+		return false, err
 	}
-	return nil
+	return r.loaded(shown), nil
 }
 
-func ResetPFRule() error {
-	path, err := exec.LookPath(pfctl)
-	if err != nil {
-		return fmt.Errorf("%s not found: %s", pfctl, err)
+// loaded reports whether r is in rules shown by pfctl
+func (r PFRule) loaded(shown []string) bool {
+	expected := normalizePFRule(string(r))
+	for _, l := range shown {
+		if normalizePFRule(l) == expected {
+			return true
+		}
 	}
-	cmd := exec.Command(path, "-df", "/etc/pf.conf")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to execute %s(reset): output=%s", pfctl, out)
+	return false
+}
+
+// normalizePFRule removes differences between rule loaded and shown by pfctl
+func normalizePFRule(rule string) string {
+	fields := strings.Fields(strings.NewReplacer("(", "", ")", "").Replace(rule))
+	normalized := []string{}
+	for n := 0; n < len(fields); n++ {
+		f := fields[n]
+		switch {
+		case f == "flags" && n+1 < len(fields):
+			n++
+			continue
+		case f == "keep" && n+1 < len(fields) && fields[n+1] == "state":
+			n++
+			continue
+		case f == "port" && n+1 < len(fields) && fields[n+1] != "=":
+			normalized = append(normalized, f, "=")
+			continue
+		}
+		if _, network, err := net.ParseCIDR(f); err == nil {
+			f = network.String()
+		}
+		normalized = append(normalized, f)
+	}
+	return strings.Join(normalized, " ")
+}
+
+// pfRuleRegexp matches rule lines shown by pfctl
+var pfRuleRegexp = regexp.MustCompile(`^(rdr|nat|binat|pass|block|match)\s`)
+
+// extraPFRules returns rules shown by pfctl which are not in rules
+func extraPFRules(rules []PFRule, shown []string) []PFRule {
+	extra := []PFRule{}
+	for _, l := range shown {
+		if !pfRuleRegexp.MatchString(l) {
+			continue
+		}
+		found := false
+		for _, r := range rules {
+			if r.loaded([]string{l}) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			extra = append(extra, PFRule(l))
+		}
+	}
+	return extra
+}
+
+// GetCommandStr returns rule line
+func (r PFRule) GetCommandStr() string {
+	return string(r)
+}
+
+// showPFAnchor returns rules loaded in PFAnchor
+func showPFAnchor(run Runner) ([]string, error) {
+	shown := []string{}
+	for _, what := range []string{"nat", "rules"} {
+		args := []string{"-a", PFAnchor, "-s", what}
+		out, err := run.Run(pfctl, args, nil)
+		if err != nil {
+			return nil, commandError(pfctl, args, out, err)
+		}
+		shown = append(shown, strings.Split(string(out), "\n")...)
+	}
+	return shown, nil
+}
+
+var pfTokenRegexp = regexp.MustCompile(`Token : (\d+)`)
+
+// SetPFRule loads pf rules into PFAnchor and enables pf.
+// It returns token to release reference of pf by ResetPFRule
+func SetPFRule(run Runner, excludeAddrs []string) (string, error) {
+	rules := []string{}
+	for _, r := range GetPFRules(excludeAddrs) {
+		rules = append(rules, string(r))
+	}
+	rulestr := strings.Join(rules, "\n") + "\n"
+	log.Printf("set pf rules in anchor %s:\n%s", PFAnchor, rulestr)
+	args := []string{"-a", PFAnchor, "-f", "-"}
+	if out, err := run.Run(pfctl, args, []byte(rulestr)); err != nil {
+		return "", commandError(pfctl, args, out, err)
+	}
+
+	out, err := run.Run(pfctl, []string{"-E"}, nil)
+	if err == nil {
+		if m := pfTokenRegexp.FindSubmatch(out); m != nil {
+			return string(m[1]), nil
+		}
+		err = errors.New("token is not found")
+	}
+	err = commandError(pfctl, []string{"-E"}, out, err)
+	if ferr := flushPFAnchor(run); ferr != nil {
+		return "", fmt.Errorf("%s; rollback: %s", err, ferr)
+	}
+	return "", err
+}
+
+// ResetPFRule flushes rules in PFAnchor and releases reference of pf by token.
+// pf is disabled if no other reference is left
+func ResetPFRule(run Runner, token string) error {
+	if err := flushPFAnchor(run); err != nil {
+		return err
+	}
+	if token == "" {
+		return nil
+	}
+	args := []string{"-X", token}
+	if out, err := run.Run(pfctl, args, nil); err != nil {
+		return commandError(pfctl, args, out, err)
+	}
+	return nil
+}
+
+// flushPFAnchor flushes translation and filter rules in PFAnchor
+func flushPFAnchor(run Runner) error {
+	for _, what := range []string{"nat", "rules"} {
+		args := []string{"-a", PFAnchor, "-F", what}
+		if out, err := run.Run(pfctl, args, nil); err != nil {
+			return commandError(pfctl, args, out, err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,154 @@
+package firewall
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGetPFRules(t *testing.T) {
+	rules := GetPFRules([]string{"192.0.2.1"})
+	if len(rules) != 5 {
+		t.Fatalf("rules=%v", rules)
+	}
+	if rules[2].GetCommandStr() != "pass out quick proto tcp from any to 192.0.2.1" {
+		t.Error(rules[2].GetCommandStr())
+	}
+}
+
+func TestPFRuleLoaded(t *testing.T) {
+	// output of pfctl -s nat and -s rules
+	shown := []string{
+		"rdr pass inet proto tcp from any to any port = 80 -> 127.0.0.1 port 10080",
+		"pass out quick proto tcp from any to 127.0.0.0/8 flags S/SA keep state",
+		"pass out route-to (lo0) inet proto tcp from any to any port = 80 flags S/SA keep state",
+	}
+	var tests = []struct {
+		rule     PFRule
+		expected bool
+	}{
+		{"rdr pass inet proto tcp from any to any port = 80 -> 127.0.0.1 port 10080", true},
+		{"rdr pass inet proto tcp from any to any port = 443 -> 127.0.0.1 port 10080", false},
+		{"pass out quick proto tcp from any to 127.0.0.1/8", true},
+		{"pass out quick proto tcp from any to 192.0.2.1", false},
+		{"pass out route-to lo0 inet proto tcp from any to any port 80 keep state", true},
+		{"pass out route-to lo0 inet proto tcp from any to any port 443 keep state", false},
+	}
+	for _, v := range tests {
+		if got := v.rule.loaded(shown); got != v.expected {
+			t.Errorf("%s: got=%t", v.rule, got)
+		}
+	}
+}
+
+// pfRunner returns runner recording pfctl commands which enables pf with token
+func pfRunner() *RecordRunner {
+	return &RecordRunner{Handle: func(c Command) ([]byte, error) {
+		if c.String() == "pfctl -E" {
+			return []byte("No ALTQ support in kernel\nALTQ related functions disabled\npf enabled\nToken : 12345\n"), nil
+		}
+		return nil, nil
+	}}
+}
+
+func TestPFFirewall(t *testing.T) {
+	r := pfRunner()
+	fw := New(&Config{FWType: FWPF, Runner: r})
+	if err := fw.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	c := r.Commands()
+	equalLines(t, r.Lines(), []string{
+		"pfctl -a com.apple/traproxy -f -",
+		"pfctl -E",
+	})
+	if !strings.HasPrefix(c[0].Stdin, "rdr pass inet proto tcp from any to any port = 80 -> 127.0.0.1 port 10080\n") {
+		t.Errorf("stdin=%s", c[0].Stdin)
+	}
+
+	// only anchor is flushed and pf is released by token
+	r.Reset()
+	if err := fw.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), []string{
+		"pfctl -a com.apple/traproxy -F nat",
+		"pfctl -a com.apple/traproxy -F rules",
+		"pfctl -X 12345",
+	})
+
+	r.Reset()
+	if err := fw.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), []string{})
+}
+
+func TestPFFirewallEnableFailure(t *testing.T) {
+	r := &RecordRunner{Handle: func(c Command) ([]byte, error) {
+		if c.String() == "pfctl -E" {
+			return []byte("pfctl: /dev/pf: Permission denied"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}}
+	fw := New(&Config{FWType: FWPF, Runner: r})
+	err := fw.Setup()
+	if err == nil || !strings.Contains(err.Error(), "pfctl -E: exit status 1: pfctl: /dev/pf: Permission denied") {
+		t.Errorf("err=%v", err)
+	}
+	// loaded rules are flushed
+	equalLines(t, r.Lines(), []string{
+		"pfctl -a com.apple/traproxy -f -",
+		"pfctl -E",
+		"pfctl -a com.apple/traproxy -F nat",
+		"pfctl -a com.apple/traproxy -F rules",
+	})
+
+	r.Reset()
+	fw.Teardown()
+	equalLines(t, r.Lines(), []string{})
+}
+
+func TestPFFirewallNoToken(t *testing.T) {
+	r := &RecordRunner{}
+	fw := New(&Config{FWType: FWPF, Runner: r})
+	if err := fw.Setup(); err == nil || !strings.Contains(err.Error(), "token is not found") {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestPFFirewallStatusCleanup(t *testing.T) {
+	r := &RecordRunner{Handle: func(c Command) ([]byte, error) {
+		if c.String() == "pfctl -a com.apple/traproxy -s nat" {
+			return []byte("No ALTQ support in kernel\nrdr pass inet proto tcp from any to any port = 80 -> 127.0.0.1 port 10080\nrdr pass inet proto tcp from any to any port = 8080 -> 127.0.0.1 port 10080\n"), nil
+		}
+		return nil, nil
+	}}
+	rfw := New(&Config{FWType: FWPF, Runner: r}).(RuleFirewall)
+	st, err := rfw.Status(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st[0].Installed || st[1].Installed {
+		t.Errorf("status=%v", st)
+	}
+	if extra := st[len(st)-1]; !extra.Extra || extra.Rule.GetCommandStr() != "rdr pass inet proto tcp from any to any port = 8080 -> 127.0.0.1 port 10080" {
+		t.Errorf("extra=%v", extra)
+	}
+	if st[len(st)-2].Extra {
+		t.Errorf("status=%v", st)
+	}
+	equalLines(t, r.Lines(), []string{
+		"pfctl -a com.apple/traproxy -s nat",
+		"pfctl -a com.apple/traproxy -s rules",
+	})
+
+	r.Reset()
+	if err := rfw.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	equalLines(t, r.Lines(), []string{
+		"pfctl -a com.apple/traproxy -F nat",
+		"pfctl -a com.apple/traproxy -F rules",
+	})
+}
@@ -0,0 +1,101 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Runner runs firewall commands
+type Runner interface {
+	// Run runs command with stdin if not nil, and returns combined output.
+	// Error of failed command has ExitCode method
+	Run(name string, args []string, stdin []byte) ([]byte, error)
+}
+
+// ExecRunner runs commands found in PATH
+type ExecRunner struct{}
+
+// Run runs command by os/exec
+func (ExecRunner) Run(name string, args []string, stdin []byte) ([]byte, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	return cmd.CombinedOutput()
+}
+
+// Command is command run by RecordRunner
+type Command struct {
+	Name  string
+	Args  []string
+	Stdin string
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// ExitError is error of command exited with Code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns Code
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// RecordRunner records commands instead of running them
+type RecordRunner struct {
+	// Handle returns output and error of command. Commands succeed if nil
+	Handle func(c Command) ([]byte, error)
+
+	mu       sync.Mutex
+	commands []Command
+}
+
+// Run records command and calls Handle
+func (r *RecordRunner) Run(name string, args []string, stdin []byte) ([]byte, error) {
+	c := Command{Name: name, Args: append([]string{}, args...), Stdin: string(stdin)}
+	r.mu.Lock()
+	r.commands = append(r.commands, c)
+	r.mu.Unlock()
+	if r.Handle == nil {
+		return nil, nil
+	}
+	return r.Handle(c)
+}
+
+// Commands returns recorded commands
+func (r *RecordRunner) Commands() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Command{}, r.commands...)
+}
+
+// Lines returns recorded command lines
+func (r *RecordRunner) Lines() []string {
+	lines := []string{}
+	for _, c := range r.Commands() {
+		lines = append(lines, c.String())
+	}
+	return lines
+}
+
+// Reset clears recorded commands
+func (r *RecordRunner) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = nil
+}
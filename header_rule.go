@@ -0,0 +1,83 @@
+package traproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nyushi/traproxy/http"
+)
+
+// HeaderAction is operation of HeaderRule
+type HeaderAction string
+
+// header actions
+const (
+	HeaderAdd    HeaderAction = "add"
+	HeaderSet    HeaderAction = "set"
+	HeaderAppend HeaderAction = "append"
+	HeaderDel    HeaderAction = "del"
+)
+
+// ClientIPVar is replaced with client ip address in HeaderRule value
+const ClientIPVar = "$client_ip"
+
+// HeaderRule represents rewrite rule for request headers
+type HeaderRule struct {
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// ParseHeaderRule parses rule formatted as "<action>:<name>[:<value>]".
+// e.g. "set:X-Tenant-ID:abc", "append:X-Forwarded-For:$client_ip", "del:X-Debug"
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	tokens := strings.SplitN(s, ":", 3)
+	if len(tokens) < 2 || strings.TrimSpace(tokens[1]) == "" {
+		return HeaderRule{}, fmt.Errorf("invalid header rule: %s", s)
+	}
+	r := HeaderRule{
+		Action: HeaderAction(tokens[0]),
+		Name:   strings.TrimSpace(tokens[1]),
+	}
+	if len(tokens) == 3 {
+		r.Value = strings.TrimSpace(tokens[2])
+	}
+	switch r.Action {
+	case HeaderAdd, HeaderSet, HeaderAppend:
+		if len(tokens) != 3 {
+			return HeaderRule{}, fmt.Errorf("value is required: %s", s)
+		}
+	case HeaderDel:
+	default:
+		return HeaderRule{}, fmt.Errorf("unknown header action: %s", s)
+	}
+	return r, nil
+}
+
+// ViaRule returns rule to append Via header
+func ViaRule() HeaderRule {
+	return HeaderRule{Action: HeaderAppend, Name: "Via", Value: "1.1 traproxy"}
+}
+
+// ForwardedForRule returns rule to append client ip address to X-Forwarded-For header
+func ForwardedForRule() HeaderRule {
+	return HeaderRule{Action: HeaderAppend, Name: "X-Forwarded-For", Value: ClientIPVar}
+}
+
+// Apply applies rule to req
+func (r HeaderRule) Apply(req *http.RequestHeader, clientIP string) {
+	value := strings.Replace(r.Value, ClientIPVar, clientIP, -1)
+	switch r.Action {
+	case HeaderAdd:
+		req.AddHeader(r.Name, value)
+	case HeaderSet:
+		req.SetHeader(r.Name, value)
+	case HeaderAppend:
+		if v, ok := req.Header(r.Name); ok {
+			value = string(v) + ", " + value
+		}
+		req.SetHeader(r.Name, value)
+	case HeaderDel:
+		req.DelHeader(r.Name)
+	}
+}
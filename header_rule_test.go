@@ -0,0 +1,67 @@
+package traproxy
+
+import (
+	"testing"
+
+	"github.com/nyushi/traproxy/http"
+)
+
+func TestParseHeaderRule(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected HeaderRule
+		hasError bool
+	}{
+		{"set:X-Tenant-ID:abc", HeaderRule{HeaderSet, "X-Tenant-ID", "abc"}, false},
+		{"add:X-Time: 10:00", HeaderRule{HeaderAdd, "X-Time", "10:00"}, false},
+		{"append:X-Forwarded-For:$client_ip", HeaderRule{HeaderAppend, "X-Forwarded-For", "$client_ip"}, false},
+		{"del:Proxy-Connection", HeaderRule{HeaderDel, "Proxy-Connection", ""}, false},
+		{"set:X-Tenant-ID", HeaderRule{}, true},
+		{"replace:X-Tenant-ID:abc", HeaderRule{}, true},
+		{"del:", HeaderRule{}, true},
+		{"del", HeaderRule{}, true},
+	}
+	for _, v := range tests {
+		r, err := ParseHeaderRule(v.in)
+		if v.hasError {
+			if err == nil {
+				t.Errorf("%s: error not returned", v.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", v.in, err)
+		}
+		if r != v.expected {
+			t.Errorf("%s: got=%+v, expected=%+v", v.in, r, v.expected)
+		}
+	}
+}
+
+func TestHeaderRuleApply(t *testing.T) {
+	req, err := http.NewRequestHeader([]byte("GET / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"X-Forwarded-For: 192.0.2.1\r\n" +
+		"Proxy-Connection: keep-alive\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []HeaderRule{
+		ViaRule(),
+		ForwardedForRule(),
+		{HeaderDel, "Proxy-Connection", ""},
+		{HeaderSet, "X-Tenant-ID", "abc"},
+	}
+	for _, r := range rules {
+		r.Apply(req, "10.0.0.1")
+	}
+	got := string(req.Bytes())
+	expected := "GET / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"X-Forwarded-For: 192.0.2.1, 10.0.0.1\r\n" +
+		"Via: 1.1 traproxy\r\n" +
+		"X-Tenant-ID: abc\r\n\r\n"
+	if got != expected {
+		t.Errorf("got=%q, expected=%q", got, expected)
+	}
+}
@@ -0,0 +1,201 @@
+package http
+
+import "errors"
+
+// ErrInvalidChunk is returned for malformed chunked body
+var ErrInvalidChunk = errors.New("invalid chunked body")
+
+// maxChunkLine is limit of chunk extension and trailer line
+const maxChunkLine = 4096
+
+type chunkState int
+
+const (
+	chunkSize chunkState = iota
+	chunkExt
+	chunkExtName
+	chunkExtNameToken
+	chunkExtNameEnd
+	chunkExtValue
+	chunkExtValueToken
+	chunkExtQuoted
+	chunkExtQuotedPair
+	chunkSizeLF
+	chunkData
+	chunkDataCR
+	chunkDataLF
+	chunkTrailer
+	chunkTrailerLine
+	chunkTrailerLF
+	chunkEndLF
+	chunkDone
+	chunkInvalid
+)
+
+// chunkedBody finds end of chunked body in streamed bytes.
+// Lines must end with CRLF because bytes are forwarded as is
+type chunkedBody struct {
+	state  chunkState
+	size   int64
+	digits int
+	line   int
+}
+
+// consume returns length of bytes in b belonging to the body
+func (c *chunkedBody) consume(b []byte) (int, error) {
+	n := 0
+	for n < len(b) && c.state != chunkDone {
+		ch := b[n]
+		switch c.state {
+		case chunkSize:
+			if v, ok := unhex(ch); ok {
+				c.digits++
+				if c.digits > 15 {
+					return n, ErrInvalidChunk
+				}
+				c.size = c.size*16 + int64(v)
+				n++
+				continue
+			}
+			if c.digits == 0 {
+				return n, ErrInvalidChunk
+			}
+			c.state = chunkExt
+			c.line = 0
+			continue
+		case chunkExt, chunkExtName, chunkExtNameToken, chunkExtNameEnd,
+			chunkExtValue, chunkExtValueToken, chunkExtQuoted, chunkExtQuotedPair:
+			state := extState(c.state, ch)
+			if state == chunkInvalid {
+				return n, ErrInvalidChunk
+			}
+			c.state = state
+			c.line++
+			if c.line > maxChunkLine {
+				return n, ErrInvalidChunk
+			}
+		case chunkSizeLF:
+			if ch != '\n' {
+				return n, ErrInvalidChunk
+			}
+			if c.size == 0 {
+				c.state = chunkTrailer
+			} else {
+				c.state = chunkData
+			}
+		case chunkData:
+			m := int64(len(b) - n)
+			if m > c.size {
+				m = c.size
+			}
+			c.size -= m
+			n += int(m)
+			if c.size == 0 {
+				c.state = chunkDataCR
+			}
+			continue
+		case chunkDataCR:
+			if ch != '\r' {
+				return n, ErrInvalidChunk
+			}
+			c.state = chunkDataLF
+		case chunkDataLF:
+			if ch != '\n' {
+				return n, ErrInvalidChunk
+			}
+			c.state = chunkSize
+			c.digits = 0
+		case chunkTrailer:
+			if ch == '\r' {
+				c.state = chunkEndLF
+			} else {
+				c.state = chunkTrailerLine
+				c.line = 0
+				continue
+			}
+		case chunkTrailerLine:
+			switch {
+			case ch == '\r':
+				c.state = chunkTrailerLF
+			case isCTL(ch) && ch != '\t':
+				return n, ErrInvalidChunk
+			default:
+				c.line++
+				if c.line > maxChunkLine {
+					return n, ErrInvalidChunk
+				}
+			}
+		case chunkTrailerLF:
+			if ch != '\n' {
+				return n, ErrInvalidChunk
+			}
+			c.state = chunkTrailer
+		case chunkEndLF:
+			if ch != '\n' {
+				return n, ErrInvalidChunk
+			}
+			c.state = chunkDone
+		}
+		n++
+	}
+	return n, nil
+}
+
+// extState returns state after ch in chunk-ext or end of chunk-size line.
+// chunk-ext = *( BWS ";" BWS name [ BWS "=" BWS ( token / quoted-string ) ] )
+func extState(state chunkState, ch byte) chunkState {
+	switch {
+	case state == chunkExtQuoted && ch == '"':
+		return chunkExt
+	case state == chunkExtQuoted && ch == '\\':
+		return chunkExtQuotedPair
+	case state == chunkExtQuoted || state == chunkExtQuotedPair:
+		if isCTL(ch) && ch != '\t' {
+			return chunkInvalid
+		}
+		return chunkExtQuoted
+	case tokenChars[ch]:
+		switch state {
+		case chunkExtName, chunkExtNameToken:
+			return chunkExtNameToken
+		case chunkExtValue, chunkExtValueToken:
+			return chunkExtValueToken
+		}
+	case isWhitespace(ch):
+		switch state {
+		case chunkExtNameToken:
+			return chunkExtNameEnd
+		case chunkExtValueToken:
+			return chunkExt
+		}
+		return state
+	case ch == '"' && state == chunkExtValue:
+		return chunkExtQuoted
+	case ch == '=' && (state == chunkExtNameToken || state == chunkExtNameEnd):
+		return chunkExtValue
+	case state == chunkExt || state == chunkExtNameToken || state == chunkExtNameEnd || state == chunkExtValueToken:
+		switch ch {
+		case ';':
+			return chunkExtName
+		case '\r':
+			return chunkSizeLF
+		}
+	}
+	return chunkInvalid
+}
+
+func (c *chunkedBody) done() bool {
+	return c.state == chunkDone
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,95 @@
+package http
+
+import "testing"
+
+var chunkedTests = []struct {
+	in       string
+	expected int
+	done     bool
+	hasError bool
+}{
+	{"5\r\nhello\r\n0\r\n\r\n", 15, true, false},
+	{"5\r\nhello\r\n0\r\n\r\nGET / HTTP/1.1\r\n\r\n", 15, true, false},
+	{"A;name=value\r\n0123456789\r\n000\r\n\r\n", 33, true, false},
+	{"5 ;ext\r\nhello\r\n0\r\nTrailer: 1\r\n\r\n", 32, true, false},
+	{"5\r\nhel", 6, false, false},
+	{"5\nhello\r\n0\r\n\r\n", 1, false, true},
+	{"5\r\nhelloX\r\n0\r\n\r\n", 8, false, true},
+	{"\r\nhello\r\n", 0, false, true},
+	{"5x\r\nhello\r\n", 1, false, true},
+	{"-5\r\nhello\r\n", 0, false, true},
+	{"1000000000000000\r\n", 15, false, true},
+	{"0\r\nTrailer: 1\n\r\n", 13, false, true},
+	{"5 ; a = \"b\\\"c\" ; d\r\nhello\r\n0\r\n\r\n", 32, true, false},
+	{"5 xyz\r\nhello\r\n0\r\n\r\n", 2, false, true},
+	{"5;\r\nhello\r\n0\r\n\r\n", 2, false, true},
+	{"5;a=\r\nhello\r\n0\r\n\r\n", 4, false, true},
+	{"5;a=b c\r\nhello\r\n0\r\n\r\n", 6, false, true},
+	{"5;a@b\r\nhello\r\n", 3, false, true},
+	{"5;a=\"b\x01\"\r\nhello\r\n", 6, false, true},
+}
+
+func TestChunkedBody(t *testing.T) {
+	for _, v := range chunkedTests {
+		c := &chunkedBody{}
+		n, err := c.consume([]byte(v.in))
+		if n != v.expected || c.done() != v.done || (err != nil) != v.hasError {
+			t.Errorf("%q: n=%d, done=%v, err=%v", v.in, n, c.done(), err)
+		}
+
+		// byte by byte
+		c = &chunkedBody{}
+		total := 0
+		for i := 0; i < len(v.in); i++ {
+			n, err = c.consume([]byte(v.in[i : i+1]))
+			total += n
+			if err != nil || c.done() {
+				break
+			}
+		}
+		if total != v.expected || c.done() != v.done || (err != nil) != v.hasError {
+			t.Errorf("%q: byte by byte: n=%d, done=%v, err=%v", v.in, total, c.done(), err)
+		}
+	}
+}
+
+func TestRequestHeaderReadBodyChunked(t *testing.T) {
+	r, err := NewRequestHeader([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, body := ReadRequestBody([]byte("3\r\nabc\r"), r)
+	if string(body) != "3\r\nabc\r" || len(rest) != 0 || r.IsCompleted() {
+		t.Errorf("body=%q, rest=%q, completed=%v", body, rest, r.IsCompleted())
+	}
+	rest, body = ReadRequestBody([]byte("\n0\r\n\r\nrest"), r)
+	if string(body) != "\n0\r\n\r\n" || string(rest) != "rest" || !r.IsCompleted() {
+		t.Errorf("body=%q, rest=%q, completed=%v", body, rest, r.IsCompleted())
+	}
+	if r.BodySize != 13 || r.BodyRead != 13 {
+		t.Errorf("size=%d, read=%d", r.BodySize, r.BodyRead)
+	}
+}
+
+func FuzzChunkedBody(f *testing.F) {
+	for _, v := range chunkedTests {
+		f.Add([]byte(v.in), uint(len(v.in)/2))
+	}
+	f.Fuzz(func(t *testing.T, b []byte, split uint) {
+		c := &chunkedBody{}
+		n, err := c.consume(b)
+
+		// result must not depend on how bytes are split
+		s := int(split % uint(len(b)+1))
+		c2 := &chunkedBody{}
+		n2, err2 := c2.consume(b[:s])
+		if err2 == nil && !c2.done() {
+			var m int
+			m, err2 = c2.consume(b[s:])
+			n2 += m
+		}
+		if n != n2 || (err != nil) != (err2 != nil) || c.done() != c2.done() {
+			t.Fatalf("%q split at %d: n=%d/%d, err=%v/%v", b, s, n, n2, err, err2)
+		}
+	})
+}
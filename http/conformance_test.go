@@ -0,0 +1,139 @@
+package http
+
+import (
+	"bytes"
+	"testing"
+)
+
+// conformanceTests is corpus of request headers parsed as RFC 9112.
+// out is header written to proxy
+var conformanceTests = []struct {
+	name     string
+	in       string
+	err      error
+	out      string
+	bodySize int
+	chunked  bool
+}{
+	// field lines
+	{"no whitespace after colon", "GET / HTTP/1.1\r\nHost:example.com\r\n\r\n", nil,
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", 0, false},
+	{"whitespace around value", "GET / HTTP/1.1\r\nHost: \texample.com \t\r\n\r\n", nil,
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", 0, false},
+	{"empty value", "GET / HTTP/1.1\r\nX-Empty:\r\n\r\n", nil,
+		"GET / HTTP/1.1\r\nX-Empty: \r\n\r\n", 0, false},
+	{"obs-text in value", "GET / HTTP/1.1\r\nX-A: \xe3\x81\x82\r\n\r\n", nil,
+		"GET / HTTP/1.1\r\nX-A: \xe3\x81\x82\r\n\r\n", 0, false},
+	{"obs-fold", "GET / HTTP/1.1\r\nX-A: 1\r\n 2\r\n\r\n", ErrObsFold, "", 0, false},
+	{"obs-fold by tab", "GET / HTTP/1.1\r\nX-A: 1\r\n\t2\r\n\r\n", ErrObsFold, "", 0, false},
+	{"whitespace before first field", "GET / HTTP/1.1\r\n Host: example.com\r\n\r\n", ErrObsFold, "", 0, false},
+	{"whitespace before colon", "GET / HTTP/1.1\r\nHost : example.com\r\n\r\n", ErrInvalidHeader, "", 0, false},
+	{"no colon", "GET / HTTP/1.1\r\nHost example.com\r\n\r\n", ErrInvalidHeader, "", 0, false},
+	{"empty name", "GET / HTTP/1.1\r\n: example.com\r\n\r\n", ErrInvalidHeader, "", 0, false},
+	{"NUL in value", "GET / HTTP/1.1\r\nX-A: a\x00b\r\n\r\n", ErrInvalidHeader, "", 0, false},
+	{"duplicate host", "GET / HTTP/1.1\r\nHost: a\r\nhost: b\r\n\r\n", ErrDuplicateHost, "", 0, false},
+
+	// line endings
+	{"bare LF", "GET / HTTP/1.1\nHost: example.com\n\n", nil,
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", 0, false},
+	{"mixed line endings", "GET / HTTP/1.1\nHost: example.com\r\n\n", nil,
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", 0, false},
+	{"empty lines before request line", "\r\n\nGET / HTTP/1.1\r\n\r\n", nil,
+		"GET / HTTP/1.1\r\n\r\n", 0, false},
+	{"bare CR in value", "GET / HTTP/1.1\r\nX-A: a\rb\r\n\r\n", ErrBareCR, "", 0, false},
+	{"bare CR as line end", "GET / HTTP/1.1\rHost: example.com\r\n\r\n", ErrBareCR, "", 0, false},
+
+	// request line
+	{"missing version", "GET /\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+	{"double space", "GET  / HTTP/1.1\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+	{"space in target", "GET /a b HTTP/1.1\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+	{"invalid method", "G(T / HTTP/1.1\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+	{"lower case version", "GET / http/1.1\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+	{"long version", "GET / HTTP/1.10\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+	{"tab separator", "GET\t/ HTTP/1.1\r\n\r\n", ErrInvalidRequestLine, "", 0, false},
+
+	// content-length
+	{"content-length", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\n", nil,
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\n", 5, false},
+	{"same content-length list", "POST / HTTP/1.1\r\nContent-Length: 5, 5\r\n\r\n", nil,
+		"POST / HTTP/1.1\r\nContent-Length: 5, 5\r\n\r\n", 5, false},
+	{"duplicate same content-length", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\n", nil,
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\n", 5, false},
+	{"conflicting content-length list", "POST / HTTP/1.1\r\nContent-Length: 5, 6\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+	{"conflicting content-length", "POST / HTTP/1.1\r\nContent-Length: 5\r\ncontent-length: 6\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+	{"negative content-length", "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+	{"signed content-length", "POST / HTTP/1.1\r\nContent-Length: +1\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+	{"hex content-length", "POST / HTTP/1.1\r\nContent-Length: 0x10\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+	{"empty content-length", "POST / HTTP/1.1\r\nContent-Length:\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+	{"overflow content-length", "POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\n", ErrInvalidContentLength, "", 0, false},
+
+	// transfer-encoding
+	{"chunked", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n", nil,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n", -1, true},
+	{"chunked after gzip", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n", nil,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n", -1, true},
+	{"codings in multiple lines", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n", nil,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n", -1, true},
+	{"transfer-encoding with content-length", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n",
+		ErrInvalidTransferEncoding, "", 0, false},
+	{"chunked is not final", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", ErrInvalidTransferEncoding, "", 0, false},
+	{"chunked twice", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n",
+		ErrInvalidTransferEncoding, "", 0, false},
+	{"unknown coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrInvalidTransferEncoding, "", 0, false},
+	{"transfer-encoding in HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n", ErrInvalidTransferEncoding, "", 0, false},
+}
+
+func TestConformance(t *testing.T) {
+	for _, v := range conformanceTests {
+		r, err := NewRequestHeader([]byte(v.in))
+		if err != v.err {
+			t.Errorf("%s: error not match: expected=%v, got=%v", v.name, v.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := string(r.Bytes()); got != v.out {
+			t.Errorf("%s: got=%q, expected=%q", v.name, got, v.out)
+		}
+		if r.BodySize != v.bodySize || r.Chunked != v.chunked {
+			t.Errorf("%s: invalid framing: size=%d, chunked=%v", v.name, r.BodySize, r.Chunked)
+		}
+	}
+}
+
+func FuzzNewRequestHeader(f *testing.F) {
+	for _, v := range conformanceTests {
+		f.Add([]byte(v.in))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := NewRequestHeader(b)
+		if err != nil {
+			return
+		}
+		// header written to proxy must be parsed as the same request
+		out := r.Bytes()
+		if HeaderEnd(out) != len(out) {
+			t.Fatalf("%q: invalid end of header", out)
+		}
+		r2, err := NewRequestHeader(out)
+		if err != nil {
+			t.Fatalf("%q: %s", out, err)
+		}
+		if !bytes.Equal(r2.Bytes(), out) || r2.BodySize != r.BodySize || r2.Chunked != r.Chunked {
+			t.Fatalf("%q: request is changed", out)
+		}
+	})
+}
+
+func FuzzResponseTracker(f *testing.F) {
+	f.Add([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	f.Add([]byte("HTTP/1.1 200 OK\nTransfer-Encoding: chunked\n\n2\r\nok\r\n0\r\n\r\n"))
+	f.Add([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tracker := &ResponseTracker{}
+		tracker.AddRequest(&RequestHeader{ReqLineTokens: [][]byte{[]byte("GET")}})
+		tracker.Feed(b)
+		tracker.Close()
+	})
+}
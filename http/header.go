@@ -0,0 +1,171 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidRequestLine is returned for malformed request line
+	ErrInvalidRequestLine = errors.New("invalid request line")
+	// ErrInvalidHeader is returned for malformed header field line
+	ErrInvalidHeader = errors.New("invalid header field")
+	// ErrObsFold is returned for header field line folded by obs-fold
+	ErrObsFold = errors.New("obsolete line folding")
+	// ErrBareCR is returned for CR not followed by LF
+	ErrBareCR = errors.New("bare CR in header")
+	// ErrInvalidContentLength is returned for malformed or conflicting Content-Length
+	ErrInvalidContentLength = errors.New("invalid content-length")
+	// ErrInvalidTransferEncoding is returned for Transfer-Encoding which framing is ambiguous
+	ErrInvalidTransferEncoding = errors.New("invalid transfer-encoding")
+	// ErrDuplicateHost is returned for request with multiple Host
+	ErrDuplicateHost = errors.New("duplicate host")
+)
+
+// HeaderEnd returns length of header including the empty line terminating it,
+// or -1 if b does not have whole header. Lines may end with bare LF.
+// Empty lines preceding the start line are included
+func HeaderEnd(b []byte) int {
+	start := len(b) - len(skipEmptyLines(b))
+	for i := start; i < len(b); {
+		j := bytes.IndexByte(b[i:], '\n')
+		if j == -1 {
+			return -1
+		}
+		i += j + 1
+		if i < len(b) && b[i] == '\n' {
+			return i + 1
+		}
+		if i+1 < len(b) && b[i] == '\r' && b[i+1] == '\n' {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// skipEmptyLines returns b without leading empty lines
+func skipEmptyLines(b []byte) []byte {
+	for {
+		switch {
+		case bytes.HasPrefix(b, eol):
+			b = b[len(eol):]
+		case len(b) > 0 && b[0] == '\n':
+			b = b[1:]
+		default:
+			return b
+		}
+	}
+}
+
+// nextLine returns the first line of b without CRLF or LF and rest
+func nextLine(b []byte) ([]byte, []byte, error) {
+	var rest []byte
+	if i := bytes.IndexByte(b, '\n'); i != -1 {
+		b, rest = b[:i], b[i+1:]
+		if len(b) > 0 && b[len(b)-1] == '\r' {
+			b = b[:len(b)-1]
+		}
+	}
+	if bytes.IndexByte(b, '\r') != -1 {
+		return nil, nil, ErrBareCR
+	}
+	return b, rest, nil
+}
+
+// parseField returns name and value of header field line.
+// Whitespaces around value are trimmed
+func parseField(line []byte) ([]byte, []byte, error) {
+	if len(line) > 0 && isWhitespace(line[0]) {
+		return nil, nil, ErrObsFold
+	}
+	i := bytes.IndexByte(line, ':')
+	if i == -1 || !isToken(line[:i]) {
+		// whitespace between name and colon is not allowed
+		return nil, nil, ErrInvalidHeader
+	}
+	value := trimWhitespace(line[i+1:])
+	for _, c := range value {
+		if isCTL(c) && c != '\t' {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+	return line[:i], value, nil
+}
+
+// parseContentLength returns value of Content-Length.
+// Value may be a list of the same lengths
+func parseContentLength(value []byte) (int, error) {
+	size := -1
+	for len(value) > 0 {
+		elem := value
+		if i := bytes.IndexByte(value, ','); i != -1 {
+			elem, value = value[:i], value[i+1:]
+		} else {
+			value = nil
+		}
+		n, err := parseDigits(trimWhitespace(elem))
+		if err != nil || (size != -1 && size != n) {
+			return 0, ErrInvalidContentLength
+		}
+		size = n
+	}
+	if size == -1 {
+		return 0, ErrInvalidContentLength
+	}
+	return size, nil
+}
+
+// parseDigits parses 1*DIGIT. Signs are not allowed
+func parseDigits(b []byte) (int, error) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, ErrInvalidContentLength
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidContentLength
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, nil
+}
+
+func trimWhitespace(b []byte) []byte {
+	for len(b) > 0 && isWhitespace(b[0]) {
+		b = b[1:]
+	}
+	for len(b) > 0 && isWhitespace(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isCTL(c byte) bool {
+	return c < ' ' || c == 0x7f
+}
+
+// tokenChars is table of characters allowed in token
+var tokenChars = func() (t [256]bool) {
+	for c := 0x21; c < 0x7f; c++ {
+		t[c] = !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", rune(c))
+	}
+	return t
+}()
+
+// isToken returns whether b is token of RFC 9110
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !tokenChars[c] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package http
+
+import "testing"
+
+func TestHeaderEnd(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected int
+	}{
+		{"", -1},
+		{"GET / HTTP/1.1\r\n", -1},
+		{"GET / HTTP/1.1\r\n\r", -1},
+		{"GET / HTTP/1.1\r\n\r\n", 18},
+		{"GET / HTTP/1.1\r\n\r\nrest", 18},
+		{"GET / HTTP/1.1\n\n", 16},
+		{"GET / HTTP/1.1\n\r\n", 17},
+		{"GET / HTTP/1.1\r\nA: 1\n\n", 22},
+		{"\r\n\r\n", -1},
+		{"\r\nGET / HTTP/1.1\r\n\r\n", 20},
+	}
+	for _, v := range tests {
+		if got := HeaderEnd([]byte(v.in)); got != v.expected {
+			t.Errorf("%q: expected=%d, got=%d", v.in, v.expected, got)
+		}
+	}
+}
+
+func TestParseField(t *testing.T) {
+	var tests = []struct {
+		in    string
+		name  string
+		value string
+		err   error
+	}{
+		{"A: 1", "A", "1", nil},
+		{"A:1", "A", "1", nil},
+		{"A:  1 2\t", "A", "1 2", nil},
+		{"A: 1:2", "A", "1:2", nil},
+		{"A :1", "", "", ErrInvalidHeader},
+		{"A@: 1", "", "", ErrInvalidHeader},
+		{" A: 1", "", "", ErrObsFold},
+		{"A: \x7f", "", "", ErrInvalidHeader},
+	}
+	for _, v := range tests {
+		name, value, err := parseField([]byte(v.in))
+		if err != v.err || string(name) != v.name || string(value) != v.value {
+			t.Errorf("%q: name=%q, value=%q, err=%v", v.in, name, value, err)
+		}
+	}
+}
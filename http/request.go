@@ -2,16 +2,15 @@ package http
 
 import (
 	"bytes"
-	"strconv"
+	"errors"
 )
 
 // ReadRequestHeader reads header information from bytes
 func ReadRequestHeader(rb []byte) ([]byte, *RequestHeader, error) {
-	headerEnd := bytes.Index(rb, eoh)
-	if headerEnd == -1 {
+	boundary := HeaderEnd(rb)
+	if boundary == -1 {
 		return rb, nil, nil
 	}
-	boundary := headerEnd + len(eoh)
 	reqBytes := rb[:boundary]
 	rest := rb[boundary:]
 
@@ -19,20 +18,11 @@ func ReadRequestHeader(rb []byte) ([]byte, *RequestHeader, error) {
 	return rest, req, err
 }
 
-// ReadRequestBody reads request body from bytes
+// ReadRequestBody reads request body from bytes.
+// Malformed chunked body ends at the error
 func ReadRequestBody(rb []byte, req *RequestHeader) ([]byte, []byte) {
-	var body []byte
-	var rest []byte
-	s := req.BodySize - req.BodyRead
-	if len(rb) > s {
-		body = rb[:s]
-		rest = rb[s:]
-	} else {
-		body = rb
-		rest = []byte{}
-	}
-	req.BodyRead += len(body)
-	return rest, body
+	n, _ := req.ReadBody(rb)
+	return rb[n:], rb[:n]
 }
 
 var (
@@ -44,31 +34,120 @@ var (
 type RequestHeader struct {
 	ReqLineTokens [][]byte
 	Headers       [][][]byte
-	BodySize      int
-	BodyRead      int
+	// BodySize is -1 until the end of chunked body is read
+	BodySize int
+	BodyRead int
+	Chunked  bool
+
+	chunked chunkedBody
 }
 
-// NewRequestHeader returns RequestHeader from bytes
-func NewRequestHeader(b []byte) (*RequestHeader, error) {
-	lines := bytes.Split(b, eol)
-	reqline := bytes.Split(lines[0], []byte{' '})
+// DefaultMaxHeaderSize is default limit of request header size
+const DefaultMaxHeaderSize = 32 * 1024
+
+// ErrHeaderTooLarge is returned when request header exceeds the limit
+var ErrHeaderTooLarge = errors.New("request header is too large")
+
+var (
+	// HeaderTooLargeResponse is response for request with too large header
+	HeaderTooLargeResponse = []byte("HTTP/1.1 431 Request Header Fields Too Large\r\n" +
+		"Connection: close\r\nContent-Length: 0\r\n\r\n")
+	// BadRequestResponse is response for malformed or ambiguous request
+	BadRequestResponse = []byte("HTTP/1.1 400 Bad Request\r\n" +
+		"Connection: close\r\nContent-Length: 0\r\n\r\n")
+	// BadGatewayResponse is response for request which upstream is not available
+	BadGatewayResponse = []byte("HTTP/1.1 502 Bad Gateway\r\n" +
+		"Connection: close\r\nContent-Length: 0\r\n\r\n")
+)
+
+var (
+	colonSpace       = []byte{':', ' '}
+	contentLength    = []byte("content-length")
+	transferEncoding = []byte("transfer-encoding")
+	host             = []byte("host")
+	chunkedCoding    = []byte("chunked")
+	http10           = []byte("HTTP/1.0")
+)
+
+// parseRequestLine splits request line into method, request-target and version
+func parseRequestLine(line []byte, tokens [][]byte) ([][]byte, error) {
+	i := bytes.IndexByte(line, ' ')
+	if i == -1 {
+		return nil, ErrInvalidRequestLine
+	}
+	j := bytes.LastIndexByte(line, ' ')
+	if i == j {
+		return nil, ErrInvalidRequestLine
+	}
+	method, target, version := line[:i], line[i+1:j], line[j+1:]
+	if !isToken(method) || len(target) == 0 || !isHTTPVersion(version) {
+		return nil, ErrInvalidRequestLine
+	}
+	for _, c := range target {
+		if isCTL(c) || c == ' ' || c >= 0x80 {
+			return nil, ErrInvalidRequestLine
+		}
+	}
+	return append(tokens, method, target, version), nil
+}
 
-	headers := [][][]byte{}
-	bodySize := 0
+// isHTTPVersion returns whether b is HTTP/DIGIT.DIGIT
+func isHTTPVersion(b []byte) bool {
+	return len(b) == 8 && bytes.HasPrefix(b, []byte("HTTP/")) &&
+		'0' <= b[5] && b[5] <= '9' && b[6] == '.' && '0' <= b[7] && b[7] <= '9'
+}
 
-	headerLines := lines[1:]
-	for _, l := range headerLines {
-		tokens := bytes.SplitN(l, []byte{':', ' '}, 2)
-		if len(tokens) == 2 {
-			headers = append(headers, tokens)
+// NewRequestHeader returns RequestHeader from bytes.
+// Tokens and headers refer to b without copying.
+// Message which framing is ambiguous is rejected as RFC 9112
+func NewRequestHeader(b []byte) (*RequestHeader, error) {
+	line, rest, err := nextLine(skipEmptyLines(b))
+	if err != nil {
+		return nil, err
+	}
+	reqline, err := parseRequestLine(line, make([][]byte, 0, 3))
+	if err != nil {
+		return nil, err
+	}
+
+	// all pairs of header share one backing array
+	n := bytes.Count(rest, []byte{'\n'})
+	pairs := make([][]byte, 0, 2*n)
+	headers := make([][][]byte, 0, n)
+	bodySize := -1
+	hasTE, isChunked, hasHost := false, false, false
+	for len(rest) > 0 {
+		line, rest, err = nextLine(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
 		}
+		name, value, err := parseField(line)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, name, value)
+		headers = append(headers, pairs[len(pairs)-2:len(pairs):len(pairs)])
 
-		if bytes.Equal(bytes.ToLower(tokens[0]), []byte("content-length")) {
-			size, err := strconv.Atoi(string(tokens[1]))
-			if err != nil {
-				return nil, err
+		switch {
+		case bytes.EqualFold(name, contentLength):
+			size, err := parseContentLength(value)
+			if err != nil || (bodySize != -1 && bodySize != size) {
+				return nil, ErrInvalidContentLength
 			}
 			bodySize = size
+		case bytes.EqualFold(name, transferEncoding):
+			hasTE = true
+			if isChunked, err = readTransferCodings(value, isChunked); err != nil {
+				return nil, err
+			}
+		case bytes.EqualFold(name, host):
+			if hasHost {
+				return nil, ErrDuplicateHost
+			}
+			hasHost = true
 		}
 	}
 
@@ -78,20 +157,78 @@ func NewRequestHeader(b []byte) (*RequestHeader, error) {
 		BodySize:      bodySize,
 		BodyRead:      0,
 	}
+	if hasTE {
+		// framing by both of them or by unknown coding is ambiguous
+		if bodySize != -1 || !isChunked || bytes.Equal(reqline[2], http10) {
+			return nil, ErrInvalidTransferEncoding
+		}
+		r.Chunked = true
+	} else if bodySize == -1 {
+		r.BodySize = 0
+	}
 	return r, nil
 }
 
-// Bytes returns byte slice of RequestHeader
-func (r *RequestHeader) Bytes() []byte {
-	lines := [][]byte{}
-	lines = append(lines, bytes.Join(r.ReqLineTokens, []byte{' '}))
+// readTransferCodings reads codings in value following codings already read.
+// chunked is true if the last coding is chunked
+func readTransferCodings(value []byte, chunked bool) (bool, error) {
+	for len(value) > 0 {
+		coding := value
+		if i := bytes.IndexByte(value, ','); i != -1 {
+			coding, value = value[:i], value[i+1:]
+		} else {
+			value = nil
+		}
+		coding = trimWhitespace(coding)
+		if len(coding) == 0 {
+			continue
+		}
+		if chunked {
+			// chunked must be the final coding and applied once
+			return false, ErrInvalidTransferEncoding
+		}
+		chunked = bytes.EqualFold(coding, chunkedCoding)
+	}
+	return chunked, nil
+}
+
+// Size returns length of bytes returned by Bytes
+func (r *RequestHeader) Size() int {
+	size := len(eoh)
+	for _, t := range r.ReqLineTokens {
+		size += len(t) + 1
+	}
 	for _, h := range r.Headers {
-		hline := bytes.Join(h, []byte{':', ' '})
-		lines = append(lines, hline)
+		size += len(eol) + len(h[0]) + len(colonSpace) + len(h[1])
 	}
-	out := bytes.Join(lines, eol)
-	out = append(out, eoh...)
-	return out
+	return size
+}
+
+// AppendBytes appends bytes of RequestHeader to dst
+func (r *RequestHeader) AppendBytes(dst []byte) []byte {
+	dst = r.appendReqLine(dst)
+	for _, h := range r.Headers {
+		dst = append(dst, eol...)
+		dst = append(dst, h[0]...)
+		dst = append(dst, colonSpace...)
+		dst = append(dst, h[1]...)
+	}
+	return append(dst, eoh...)
+}
+
+func (r *RequestHeader) appendReqLine(dst []byte) []byte {
+	for i, t := range r.ReqLineTokens {
+		if i > 0 {
+			dst = append(dst, ' ')
+		}
+		dst = append(dst, t...)
+	}
+	return dst
+}
+
+// Bytes returns byte slice of RequestHeader
+func (r *RequestHeader) Bytes() []byte {
+	return r.AppendBytes(make([]byte, 0, r.Size()))
 }
 
 // SetRequestURI sets uri to RequestHeader
@@ -101,7 +238,7 @@ func (r *RequestHeader) SetRequestURI(uri string) {
 
 // ReqLine returns request line bytes
 func (r *RequestHeader) ReqLine() []byte {
-	return bytes.Join(r.ReqLineTokens, []byte{' '})
+	return r.appendReqLine(nil)
 }
 
 // HeadersStr returns header strings
@@ -117,6 +254,165 @@ func (r *RequestHeader) HeadersStr() [][]string {
 	return headerStr
 }
 
+// Header returns value of the first header named name. name is case-insensitive
+func (r *RequestHeader) Header(name string) ([]byte, bool) {
+	for _, h := range r.Headers {
+		if bytes.EqualFold(h[0], []byte(name)) {
+			return h[1], true
+		}
+	}
+	return nil, false
+}
+
+// AddHeader appends header
+func (r *RequestHeader) AddHeader(name, value string) {
+	r.Headers = append(r.Headers, [][]byte{[]byte(name), []byte(value)})
+}
+
+// SetHeader replaces headers named name with a header. name is case-insensitive
+func (r *RequestHeader) SetHeader(name, value string) {
+	for i, h := range r.Headers {
+		if bytes.EqualFold(h[0], []byte(name)) {
+			r.Headers[i] = [][]byte{h[0], []byte(value)}
+			r.delHeader(name, i+1)
+			return
+		}
+	}
+	r.AddHeader(name, value)
+}
+
+// DelHeader deletes all headers named name. name is case-insensitive
+func (r *RequestHeader) DelHeader(name string) {
+	r.delHeader(name, 0)
+}
+
+func (r *RequestHeader) delHeader(name string, from int) {
+	headers := r.Headers[:from]
+	for _, h := range r.Headers[from:] {
+		if !bytes.EqualFold(h[0], []byte(name)) {
+			headers = append(headers, h)
+		}
+	}
+	r.Headers = headers
+}
+
+// IsUpgrade returns whether the request asks to upgrade protocol
+func (r *RequestHeader) IsUpgrade() bool {
+	if _, ok := r.Header("Upgrade"); !ok {
+		return false
+	}
+	conn, ok := r.Header("Connection")
+	if !ok {
+		return false
+	}
+	return hasToken(bytes.ToLower(conn), "upgrade")
+}
+
+// ExpectContinue returns whether the client waits for 100 Continue before sending body
+func (r *RequestHeader) ExpectContinue() bool {
+	if len(r.ReqLineTokens) < 3 || bytes.Equal(r.ReqLineTokens[2], []byte("HTTP/1.0")) {
+		return false
+	}
+	expect, ok := r.Header("Expect")
+	if !ok {
+		return false
+	}
+	return bytes.EqualFold(bytes.TrimSpace(expect), []byte("100-continue"))
+}
+
+// ReadBody reads body from b and returns length of body bytes in b
+func (r *RequestHeader) ReadBody(b []byte) (int, error) {
+	if !r.Chunked {
+		n := r.BodySize - r.BodyRead
+		if n > len(b) {
+			n = len(b)
+		}
+		r.BodyRead += n
+		return n, nil
+	}
+	if r.IsCompleted() {
+		return 0, nil
+	}
+	n, err := r.chunked.consume(b)
+	r.BodyRead += n
+	if r.chunked.done() {
+		r.BodySize = r.BodyRead
+	}
+	return n, err
+}
+
+// TargetForm is form of request-target
+type TargetForm int
+
+const (
+	// OriginForm is absolute path and query like "/index.html"
+	OriginForm TargetForm = iota
+	// AbsoluteForm is absolute URI sent to proxy like "http://example.com/"
+	AbsoluteForm
+	// AuthorityForm is host and port of CONNECT like "example.com:443"
+	AuthorityForm
+	// AsteriskForm is "*" of server-wide OPTIONS
+	AsteriskForm
+)
+
+// TargetForm returns form of request-target
+func (r *RequestHeader) TargetForm() TargetForm {
+	target := r.ReqLineTokens[1]
+	switch {
+	case r.IsConnect():
+		return AuthorityForm
+	case bytes.Equal(r.ReqLineTokens[0], []byte("OPTIONS")) && bytes.Equal(target, []byte("*")):
+		return AsteriskForm
+	case hasScheme(target):
+		return AbsoluteForm
+	}
+	return OriginForm
+}
+
+// hasScheme returns whether target starts with scheme and "://"
+func hasScheme(target []byte) bool {
+	i := bytes.Index(target, []byte("://"))
+	if i < 1 {
+		return false
+	}
+	for j, c := range target[:i] {
+		isAlpha := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+		if !isAlpha && (j == 0 || !(('0' <= c && c <= '9') || c == '+' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authority returns host and port in request-target of absolute-form or authority-form
+func (r *RequestHeader) Authority() ([]byte, bool) {
+	target := r.ReqLineTokens[1]
+	switch r.TargetForm() {
+	case AuthorityForm:
+		return target, true
+	case AbsoluteForm:
+		target = target[bytes.Index(target, []byte("://"))+3:]
+		if i := bytes.IndexAny(target, "/?#"); i != -1 {
+			target = target[:i]
+		}
+		if i := bytes.LastIndexByte(target, '@'); i != -1 {
+			target = target[i+1:]
+		}
+		return target, true
+	}
+	return nil, false
+}
+
+// IsConnect returns whether the request is CONNECT
+func (r *RequestHeader) IsConnect() bool {
+	return bytes.Equal(r.ReqLineTokens[0], []byte("CONNECT"))
+}
+
+// SkipBody marks the rest of body as not sent
+func (r *RequestHeader) SkipBody() {
+	r.BodySize = r.BodyRead
+}
+
 // IsCompleted returns request status
 func (r *RequestHeader) IsCompleted() bool {
 	return r.BodySize == r.BodyRead
@@ -0,0 +1,345 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// ResponseHeader represents HTTP Response Header
+type ResponseHeader struct {
+	StatusLineTokens [][]byte
+	Headers          [][][]byte
+	StatusCode       int
+	// BodySize is -1 if body is delimited by chunked encoding or connection close
+	BodySize int
+	BodyRead int
+	Chunked  bool
+	Close    bool
+}
+
+// ErrResponseHeaderTooLarge is returned if response header exceeds limit
+var ErrResponseHeaderTooLarge = errors.New("response header is too large")
+
+// NewResponseHeader returns ResponseHeader from bytes.
+// Folded lines are ignored because bytes are forwarded as is
+func NewResponseHeader(b []byte) (*ResponseHeader, error) {
+	line, rest, err := nextLine(skipEmptyLines(b))
+	if err != nil {
+		return nil, err
+	}
+	statusLine := bytes.SplitN(line, []byte{' '}, 3)
+	if len(statusLine) < 2 || !isHTTPVersion(statusLine[0]) {
+		return nil, errors.New("invalid status line")
+	}
+	code, err := parseDigits(statusLine[1])
+	if err != nil || len(statusLine[1]) != 3 || code < 100 {
+		return nil, errors.New("invalid status code")
+	}
+
+	r := &ResponseHeader{
+		StatusLineTokens: statusLine,
+		Headers:          [][][]byte{},
+		StatusCode:       code,
+		BodySize:         -1,
+		Close:            bytes.Equal(statusLine[0], http10),
+	}
+	hasTE := false
+	for len(rest) > 0 {
+		line, rest, err = nextLine(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		name, value, err := parseField(line)
+		if err == ErrObsFold {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Headers = append(r.Headers, [][]byte{name, value})
+
+		value = bytes.ToLower(value)
+		switch {
+		case bytes.EqualFold(name, contentLength):
+			size, err := parseContentLength(value)
+			if err != nil || (r.BodySize != -1 && r.BodySize != size) {
+				return nil, ErrInvalidContentLength
+			}
+			r.BodySize = size
+		case bytes.EqualFold(name, transferEncoding):
+			// body is delimited by close if chunked is not the final coding
+			hasTE = true
+			if r.Chunked, err = readTransferCodings(value, r.Chunked); err != nil {
+				r.Chunked = false
+			}
+		case bytes.EqualFold(name, []byte("connection")):
+			if hasToken(value, "close") {
+				r.Close = true
+			} else if hasToken(value, "keep-alive") {
+				r.Close = false
+			}
+		}
+	}
+	if hasTE {
+		r.BodySize = -1
+	}
+	return r, nil
+}
+
+func hasToken(value []byte, token string) bool {
+	for _, v := range bytes.Split(value, []byte{','}) {
+		if bytes.Equal(bytes.TrimSpace(v), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsInformational returns whether the response is 1xx interim response
+func (r *ResponseHeader) IsInformational() bool {
+	return r.StatusCode >= 100 && r.StatusCode < 200
+}
+
+// SwitchesProtocol returns whether bytes after the response to req are not http.
+// It is true for 101 Switching Protocols and 2xx to CONNECT
+func (r *ResponseHeader) SwitchesProtocol(req *RequestHeader) bool {
+	if r.StatusCode == 101 {
+		return true
+	}
+	return req != nil && len(req.ReqLineTokens) > 0 && req.IsConnect() &&
+		r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// hasBody returns whether the response to method has body
+func (r *ResponseHeader) hasBody(method []byte) bool {
+	if r.IsInformational() || r.StatusCode == 204 || r.StatusCode == 304 {
+		return false
+	}
+	return !bytes.Equal(method, []byte("HEAD"))
+}
+
+type responseState int
+
+const (
+	stateStatus responseState = iota
+	stateBody
+	stateChunked
+	stateUntilClose
+	stateUpgraded
+)
+
+// ResponseTracker follows responses on a connection and pairs them with
+// pipelined requests. Bytes are only observed, not modified
+type ResponseTracker struct {
+	// OnResponse is called when whole response for req is read
+	OnResponse func(req *RequestHeader, resp *ResponseHeader)
+	// MaxHeaderSize is limit of response header size. Default is DefaultMaxHeaderSize
+	MaxHeaderSize int
+
+	mu      sync.Mutex
+	queue   []*RequestHeader
+	buf     []byte
+	state   responseState
+	current *ResponseHeader
+	chunked chunkedBody
+	// completed is set when a response is completed
+	completed bool
+}
+
+// AddRequest appends req to the queue of requests waiting for response
+func (t *ResponseTracker) AddRequest(req *RequestHeader) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queue = append(t.queue, req)
+}
+
+// Pending returns number of requests waiting for response
+func (t *ResponseTracker) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queue)
+}
+
+func (t *ResponseTracker) request() *RequestHeader {
+	if len(t.queue) == 0 {
+		return nil
+	}
+	return t.queue[0]
+}
+
+func (t *ResponseTracker) complete() {
+	req := t.request()
+	if req != nil {
+		t.queue = t.queue[1:]
+	}
+	resp := t.current
+	t.current = nil
+	t.state = stateStatus
+	t.completed = true
+	if t.OnResponse != nil {
+		t.OnResponse(req, resp)
+	}
+}
+
+// Feed reads bytes from server
+func (t *ResponseTracker) Feed(b []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case stateUntilClose:
+		t.current.BodyRead += len(b)
+		return nil
+	case stateUpgraded:
+		return nil
+	}
+	t.buf = append(t.buf, b...)
+	return t.read(false)
+}
+
+// FeedResponse reads bytes from server until the end of a response.
+// It returns length of bytes read and whether a response is completed.
+// Bytes after the response are not read
+func (t *ResponseTracker) FeedResponse(b []byte) (int, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case stateUntilClose:
+		t.current.BodyRead += len(b)
+		return len(b), false, nil
+	case stateUpgraded:
+		return len(b), false, nil
+	}
+	t.completed = false
+	t.buf = append(t.buf, b...)
+	err := t.read(true)
+	if !t.completed {
+		return len(b), false, err
+	}
+	// buffered bytes before b are part of the completed response
+	n := len(b) - len(t.buf)
+	t.buf = nil
+	return n, true, err
+}
+
+// read reads buffered bytes. It stops after a response if once is true
+func (t *ResponseTracker) read(once bool) error {
+	for len(t.buf) > 0 && !(once && t.completed) {
+		var err error
+		var more bool
+		switch t.state {
+		case stateStatus:
+			more, err = t.readStatus()
+		case stateBody:
+			n := t.current.BodySize - t.current.BodyRead
+			if n > len(t.buf) {
+				n = len(t.buf)
+			}
+			t.current.BodyRead += n
+			t.buf = t.buf[n:]
+			if t.current.BodyRead == t.current.BodySize {
+				t.complete()
+			}
+		case stateChunked:
+			var n int
+			n, err = t.chunked.consume(t.buf)
+			t.current.BodyRead += n
+			t.buf = t.buf[n:]
+			if err == nil && t.chunked.done() {
+				t.complete()
+			}
+		case stateUntilClose:
+			t.current.BodyRead += len(t.buf)
+			t.buf = nil
+		case stateUpgraded:
+			t.buf = nil
+		}
+		if err != nil {
+			return err
+		}
+		if more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readStatus reads response header. more is true if more bytes are needed
+func (t *ResponseTracker) readStatus() (more bool, err error) {
+	end := HeaderEnd(t.buf)
+	if end == -1 {
+		if len(t.buf) > t.maxHeaderSize() {
+			return false, ErrResponseHeaderTooLarge
+		}
+		return true, nil
+	}
+	if end > t.maxHeaderSize() {
+		return false, ErrResponseHeaderTooLarge
+	}
+	resp, err := NewResponseHeader(t.buf[:end])
+	if err != nil {
+		return false, err
+	}
+	t.buf = t.buf[end:]
+	t.current = resp
+
+	req := t.request()
+	var method []byte
+	if req != nil && len(req.ReqLineTokens) > 0 {
+		method = req.ReqLineTokens[0]
+	}
+	switch {
+	case resp.SwitchesProtocol(req):
+		// bytes after switching protocols or established tunnel are not http
+		t.complete()
+		t.state = stateUpgraded
+		t.buf = nil
+	case resp.IsInformational():
+		// interim response does not complete the request
+		t.current = nil
+		if t.OnResponse != nil {
+			t.OnResponse(t.request(), resp)
+		}
+	case !resp.hasBody(method):
+		t.complete()
+	case resp.Chunked:
+		t.chunked = chunkedBody{}
+		t.state = stateChunked
+	case resp.BodySize == 0:
+		t.complete()
+	case resp.BodySize > 0:
+		t.state = stateBody
+	default:
+		resp.Close = true
+		t.state = stateUntilClose
+	}
+	return false, nil
+}
+
+func (t *ResponseTracker) maxHeaderSize() int {
+	if t.MaxHeaderSize > 0 {
+		return t.MaxHeaderSize
+	}
+	return DefaultMaxHeaderSize
+}
+
+// Upgraded returns whether the connection switched protocols
+func (t *ResponseTracker) Upgraded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state == stateUpgraded
+}
+
+// Close notifies end of connection and completes close delimited response
+func (t *ResponseTracker) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == stateUntilClose {
+		t.complete()
+	}
+}
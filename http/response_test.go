@@ -0,0 +1,317 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newTestRequest(t *testing.T, method string) *RequestHeader {
+	req, err := NewRequestHeader([]byte(method + " / HTTP/1.1\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestNewResponseHeader(t *testing.T) {
+	var tests = []struct {
+		in       string
+		code     int
+		size     int
+		chunked  bool
+		close    bool
+		hasError bool
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 10", 200, 10, false, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Length: 10", 200, -1, true, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, Chunked", 200, -1, true, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked", 200, -1, true, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: notchunked\r\nContent-Length: 10", 200, -1, false, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: xchunked", 200, -1, false, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked, gzip", 200, -1, false, false, false},
+		{"HTTP/1.1 200 OK\r\nConnection: close", 200, -1, false, true, false},
+		{"HTTP/1.0 200 OK", 200, -1, false, true, false},
+		{"HTTP/1.0 200 OK\r\nConnection: Keep-Alive", 200, -1, false, false, false},
+		{"HTTP/1.1 404 Not Found\r\nContent-Length: 0", 404, 0, false, false, false},
+		{"HTTP/1.1 XXX OK", 0, 0, false, false, true},
+		{"XXX 200 OK", 0, 0, false, false, true},
+		{"HTTP/1.1 200 OK\r\nContent-Length: -1", 0, 0, false, false, true},
+	}
+	for _, v := range tests {
+		r, err := NewResponseHeader([]byte(v.in))
+		if v.hasError {
+			if err == nil {
+				t.Errorf("%q: error not returned", v.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", v.in, err)
+			continue
+		}
+		if r.StatusCode != v.code || r.BodySize != v.size || r.Chunked != v.chunked || r.Close != v.close {
+			t.Errorf("%q: invalid response: %+v", v.in, r)
+		}
+	}
+}
+
+type trackerResult struct {
+	method string
+	code   int
+}
+
+func feedTracker(t *testing.T, methods []string, resp string, split int) ([]trackerResult, *ResponseTracker) {
+	results := []trackerResult{}
+	tracker := &ResponseTracker{
+		OnResponse: func(req *RequestHeader, r *ResponseHeader) {
+			method := ""
+			if req != nil {
+				method = string(req.ReqLineTokens[0])
+			}
+			results = append(results, trackerResult{method, r.StatusCode})
+		},
+	}
+	for _, m := range methods {
+		tracker.AddRequest(newTestRequest(t, m))
+	}
+	b := []byte(resp)
+	for len(b) > 0 {
+		n := split
+		if n > len(b) || n == 0 {
+			n = len(b)
+		}
+		if err := tracker.Feed(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	return results, tracker
+}
+
+var trackerTests = []struct {
+	name     string
+	methods  []string
+	resp     string
+	expected []trackerResult
+	pending  int
+}{
+	{
+		"content-length",
+		[]string{"GET", "GET"},
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+			"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+		[]trackerResult{{"GET", 200}, {"GET", 404}},
+		0,
+	},
+	{
+		"chunked",
+		[]string{"GET", "GET"},
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nTrailer: 1\r\n\r\n" +
+			"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+		[]trackerResult{{"GET", 200}, {"GET", 201}},
+		0,
+	},
+	{
+		"head",
+		[]string{"HEAD", "GET"},
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+		[]trackerResult{{"HEAD", 200}, {"GET", 200}},
+		0,
+	},
+	{
+		"no body status",
+		[]string{"GET", "GET"},
+		"HTTP/1.1 204 No Content\r\n\r\n" +
+			"HTTP/1.1 304 Not Modified\r\nContent-Length: 100\r\n\r\n",
+		[]trackerResult{{"GET", 204}, {"GET", 304}},
+		0,
+	},
+	{
+		"informational",
+		[]string{"POST"},
+		"HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		[]trackerResult{{"POST", 100}, {"POST", 200}},
+		0,
+	},
+	{
+		"pending",
+		[]string{"GET", "GET", "GET"},
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhel",
+		[]trackerResult{},
+		3,
+	},
+}
+
+func TestResponseTracker(t *testing.T) {
+	for _, v := range trackerTests {
+		for _, split := range []int{0, 1, 7} {
+			results, tracker := feedTracker(t, v.methods, v.resp, split)
+			name := fmt.Sprintf("%s(split=%d)", v.name, split)
+			if fmt.Sprint(results) != fmt.Sprint(v.expected) {
+				t.Errorf("%s: got=%v, expected=%v", name, results, v.expected)
+			}
+			if tracker.Pending() != v.pending {
+				t.Errorf("%s: pending got=%d, expected=%d", name, tracker.Pending(), v.pending)
+			}
+		}
+	}
+}
+
+func TestResponseTrackerUntilClose(t *testing.T) {
+	completed := 0
+	tracker := &ResponseTracker{
+		OnResponse: func(req *RequestHeader, r *ResponseHeader) { completed++ },
+	}
+	tracker.AddRequest(newTestRequest(t, "GET"))
+	tracker.Feed([]byte("HTTP/1.1 200 OK\r\n\r\nbody"))
+	tracker.Feed([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	if completed != 0 {
+		t.Error("completed before close")
+	}
+	tracker.Close()
+	if completed != 1 {
+		t.Error("not completed at close")
+	}
+}
+
+func TestResponseTrackerError(t *testing.T) {
+	var tests = []string{
+		"XXX\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nZZ\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\naXX",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5 xyz\r\nhello\r\n0\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n 5\r\nhello\r\n0\r\n\r\n",
+	}
+	for _, v := range tests {
+		tracker := &ResponseTracker{}
+		tracker.AddRequest(newTestRequest(t, "GET"))
+		if err := tracker.Feed([]byte(v)); err == nil {
+			t.Errorf("%q: error not returned", v)
+		}
+	}
+}
+
+func TestResponseTrackerLargeChunk(t *testing.T) {
+	completed := 0
+	tracker := &ResponseTracker{
+		OnResponse: func(req *RequestHeader, r *ResponseHeader) { completed++ },
+	}
+	tracker.AddRequest(newTestRequest(t, "GET"))
+	// chunk of 4GiB
+	if err := tracker.Feed([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n100000000\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	for n := 0; n < 1<<12; n++ {
+		if err := tracker.Feed(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tracker.Feed([]byte("\r\n0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if completed != 1 {
+		t.Errorf("completed=%d", completed)
+	}
+}
+
+func TestResponseTrackerHeaderTooLarge(t *testing.T) {
+	tracker := &ResponseTracker{MaxHeaderSize: 64}
+	tracker.AddRequest(newTestRequest(t, "GET"))
+	if err := tracker.Feed([]byte("HTTP/1.1 200 OK\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for n := 0; n < 10 && err == nil; n++ {
+		err = tracker.Feed([]byte("X-Header: value\r\n"))
+	}
+	if err != ErrResponseHeaderTooLarge {
+		t.Errorf("err=%v", err)
+	}
+
+	// trailer lines are limited by chunked body
+	tracker = &ResponseTracker{}
+	tracker.AddRequest(newTestRequest(t, "GET"))
+	err = tracker.Feed([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n"))
+	for n := 0; n < 10 && err == nil; n++ {
+		err = tracker.Feed([]byte(strings.Repeat("a", 1024)))
+	}
+	if err != ErrInvalidChunk {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestResponseTrackerUpgrade(t *testing.T) {
+	results, tracker := feedTracker(t, []string{"GET"},
+		"HTTP/1.1 101 Switching Protocols\r\n\r\nHTTP/1.1 200 OK\r\n\r\n", 3)
+	if fmt.Sprint(results) != fmt.Sprint([]trackerResult{{"GET", 101}}) {
+		t.Errorf("invalid results: %v", results)
+	}
+	if !tracker.Upgraded() {
+		t.Error("not upgraded")
+	}
+	if err := tracker.Feed([]byte("XXX\r\n\r\n")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseTrackerConnect(t *testing.T) {
+	results, tracker := feedTracker(t, []string{"CONNECT"},
+		"HTTP/1.1 200 Connection established\r\n\r\nHTTP/1.1 200 OK\r\n\r\n", 3)
+	if fmt.Sprint(results) != fmt.Sprint([]trackerResult{{"CONNECT", 200}}) {
+		t.Errorf("invalid results: %v", results)
+	}
+	if !tracker.Upgraded() {
+		t.Error("not upgraded")
+	}
+
+	results, tracker = feedTracker(t, []string{"CONNECT", "GET"},
+		"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", 3)
+	if fmt.Sprint(results) != fmt.Sprint([]trackerResult{{"CONNECT", 407}, {"GET", 200}}) {
+		t.Errorf("invalid results: %v", results)
+	}
+	if tracker.Upgraded() {
+		t.Error("upgraded")
+	}
+}
+
+func TestResponseTrackerFeedResponse(t *testing.T) {
+	tracker := &ResponseTracker{}
+	for _, m := range []string{"GET", "GET", "GET"} {
+		tracker.AddRequest(newTestRequest(t, m))
+	}
+	first := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	second := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"
+	third := "HTTP/1.1 101 Switching Protocols\r\n\r\n"
+	b := []byte(first + second + third + "tunnel")
+
+	var got []string
+	// split at every 7 bytes to check partial responses
+	for len(b) > 0 {
+		size := 7
+		if size > len(b) {
+			size = len(b)
+		}
+		chunk := b[:size]
+		n, done, err := tracker.FeedResponse(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 0 {
+			got = append(got, "")
+		}
+		got[len(got)-1] += string(chunk[:n])
+		if done {
+			got = append(got, "")
+		}
+		b = b[n:]
+	}
+	// bytes after switching protocols are read with the 101 response
+	if len(got) < 3 || got[0] != first || got[1] != second || strings.Join(got[2:], "") != third+"tunnel" {
+		t.Errorf("got=%q", got)
+	}
+}
@@ -0,0 +1,8 @@
+package netns
+
+import "errors"
+
+// Do is not supported on darwin
+func Do(path string, f func() error) error {
+	return errors.New("network namespace is not supported")
+}
@@ -0,0 +1,67 @@
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Do runs f in network namespace of path such as /var/run/netns/foo or /proc/<pid>/ns/net.
+// Sockets created and commands executed by f belong to the namespace.
+// f runs on a goroutine of its own, and goroutines started by f run in the namespace of the process
+func Do(path string, f func() error) error {
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %s", err)
+	}
+	defer target.Close()
+
+	// thread left in the namespace exits with the goroutine
+	errc := make(chan error, 1)
+	go func() {
+		errc <- do(path, target, f)
+	}()
+	return <-errc
+}
+
+// do runs f in target on locked thread. The thread is not unlocked if restoring fails
+func do(path string, target *os.File, f func() error) error {
+	runtime.LockOSThread()
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %s", err)
+	}
+	defer orig.Close()
+	if err := setns(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %s", path, err)
+	}
+
+	ferr := f()
+	if err := setns(orig); err != nil {
+		return fmt.Errorf("failed to restore network namespace: %s", err)
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
+
+// sysSetns is number of setns system call which is not defined in syscall
+var sysSetns = map[string]uintptr{
+	"386":   346,
+	"amd64": 308,
+	"arm":   375,
+	"arm64": 268,
+}[runtime.GOARCH]
+
+func setns(f *os.File) error {
+	if sysSetns == 0 {
+		return fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	_, _, e := syscall.RawSyscall(sysSetns, f.Fd(), syscall.CLONE_NEWNET, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
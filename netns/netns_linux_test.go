@@ -0,0 +1,97 @@
+package netns
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// newNetns creates network namespace with loopback interface up
+func newNetns(t *testing.T) string {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	name := "traproxy-test"
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("failed to create network namespace: %s: %s", err, out)
+	}
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", name).Run() })
+	if out, err := exec.Command("ip", "-n", name, "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	return "/var/run/netns/" + name
+}
+
+func TestDo(t *testing.T) {
+	path := newNetns(t)
+	host, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ln net.Listener
+	var ifaces []net.Interface
+	var out []byte
+	err = Do(path, func() error {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return err
+		}
+		if ifaces, err = net.Interfaces(); err != nil {
+			return err
+		}
+		out, err = exec.Command("ip", "-o", "link").CombinedOutput()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if len(ifaces) != 1 || ifaces[0].Name != "lo" {
+		t.Errorf("interfaces=%v", ifaces)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); len(lines) != 1 {
+		t.Errorf("command is not run in namespace: %s", out)
+	}
+
+	// listener is not reachable from host namespace
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("listener is in host namespace")
+	}
+	err = Do(path, func() error {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// namespace is restored
+	restored, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(host) {
+		t.Errorf("interfaces=%v", restored)
+	}
+}
+
+func TestDoError(t *testing.T) {
+	called := false
+	err := Do("/nonexistent", func() error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Errorf("called=%t err=%v", called, err)
+	}
+	if err := Do(os.DevNull, func() error { return nil }); err == nil {
+		t.Error("no error")
+	}
+}
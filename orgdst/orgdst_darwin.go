@@ -17,6 +17,19 @@ const (
 	diocnatlook = uintptr(3226747927)
 )
 
+// PFResolver resolves destination of connection redirected by pf
+type PFResolver struct{}
+
+// Resolve returns original destination by DIOCNATLOOK
+func (PFResolver) Resolve(c net.Conn) (string, error) {
+	return GetOriginalDst(c)
+}
+
+// DefaultResolver returns Resolver for firewall of the platform
+func DefaultResolver() Resolver {
+	return PFResolver{}
+}
+
 // GetOriginalDst returns original destination of Conn
 func GetOriginalDst(c net.Conn) (string, error) {
 	nl := &pfiocNatlook{
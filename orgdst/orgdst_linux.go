@@ -4,30 +4,59 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"syscall"
+	"unsafe"
 )
 
-const soOriginalDst = 80
+const (
+	soOriginalDst = 80
+	// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST
+	ip6tSoOriginalDst = 80
+)
 
-// GetOriginalDst returns original destination of Conn
-func GetOriginalDst(c net.Conn) (string, error) {
+// NetfilterResolver resolves destination of connection redirected by iptables or ip6tables
+type NetfilterResolver struct{}
+
+// Resolve returns original destination by SO_ORIGINAL_DST or IP6T_SO_ORIGINAL_DST
+func (NetfilterResolver) Resolve(c net.Conn) (string, error) {
+	if addr, ok := c.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		return GetOriginalDst6(c)
+	}
+	return GetOriginalDst(c)
+}
+
+// DefaultResolver returns Resolver for firewall of the platform
+func DefaultResolver() Resolver {
+	return NetfilterResolver{}
+}
+
+// control calls f with file descriptor of c
+func control(c net.Conn, f func(fd int) error) error {
 	tcp, ok := c.(*net.TCPConn)
 	if !ok {
-		return "", errors.New("socket is not tcp")
+		return errors.New("socket is not tcp")
 	}
-	file, err := tcp.File()
+	rc, err := tcp.SyscallConn()
 	if err != nil {
-		return "", err
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
 	}
-	defer file.Close()
-	fd := file.Fd()
-
-	addr, err :=
-		syscall.GetsockoptIPv6Mreq(
-			int(fd),
-			syscall.IPPROTO_IP,
-			soOriginalDst)
+	return ferr
+}
+
+// GetOriginalDst returns original destination of Conn
+func GetOriginalDst(c net.Conn) (string, error) {
+	var addr *syscall.IPv6Mreq
+	err := control(c, func(fd int) error {
+		var err error
+		addr, err = syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -41,3 +70,29 @@ func GetOriginalDst(c net.Conn) (string, error) {
 	port := uint16(addr.Multiaddr[2])<<8 + uint16(addr.Multiaddr[3])
 	return fmt.Sprintf("%s:%d", ip, int(port)), nil
 }
+
+// GetOriginalDst6 returns original destination of Conn redirected by ip6tables
+func GetOriginalDst6(c net.Conn) (string, error) {
+	var addr syscall.RawSockaddrInet6
+	err := control(c, func(fd int) error {
+		size := uint32(syscall.SizeofSockaddrInet6)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+			syscall.IPPROTO_IPV6, ip6tSoOriginalDst,
+			uintptr(unsafe.Pointer(&addr)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	host := net.IP(addr.Addr[:]).String()
+	if zone := zoneToString(int(addr.Scope_id)); zone != "" {
+		host += "%" + zone
+	}
+	p := (*[2]byte)(unsafe.Pointer(&addr.Port))
+	port := int(p[0])<<8 + int(p[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
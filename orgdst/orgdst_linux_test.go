@@ -0,0 +1,33 @@
+package orgdst
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetfilterResolverNotRedirected(t *testing.T) {
+	for _, v := range []struct{ network, addr string }{
+		{"tcp4", "127.0.0.1:0"},
+		{"tcp6", "[::1]:0"},
+	} {
+		t.Run(v.network, func(t *testing.T) {
+			server, _ := tcpPair(t, v.network, v.addr)
+			// SO_ORIGINAL_DST fails without conntrack entry
+			if got, err := (NetfilterResolver{}).Resolve(server); err == nil {
+				t.Errorf("got=%s", got)
+			}
+		})
+	}
+}
+
+func TestGetOriginalDstNotTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := GetOriginalDst(a); err == nil {
+		t.Error("error is not returned")
+	}
+	if _, err := GetOriginalDst6(a); err == nil {
+		t.Error("error is not returned")
+	}
+}
@@ -0,0 +1,66 @@
+package orgdst
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Resolver returns original destination of connection redirected by firewall
+type Resolver interface {
+	Resolve(c net.Conn) (string, error)
+}
+
+// ResolverFunc is function used as Resolver
+type ResolverFunc func(c net.Conn) (string, error)
+
+// Resolve calls f(c)
+func (f ResolverFunc) Resolve(c net.Conn) (string, error) {
+	return f(c)
+}
+
+// TProxyResolver resolves destination of connection accepted by TPROXY
+type TProxyResolver struct{}
+
+// Resolve returns local address of c
+func (TProxyResolver) Resolve(c net.Conn) (string, error) {
+	return GetLocalDst(c)
+}
+
+// StaticResolver resolves all connections to Dst
+type StaticResolver struct {
+	Dst string
+}
+
+// Resolve returns Dst
+func (r StaticResolver) Resolve(c net.Conn) (string, error) {
+	return r.Dst, nil
+}
+
+// FakeResolver resolves connections by client address set by Set
+type FakeResolver struct {
+	mu   sync.Mutex
+	dsts map[string]string
+}
+
+// Set sets destination of connection from client address
+func (r *FakeResolver) Set(client, dst string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dsts == nil {
+		r.dsts = map[string]string{}
+	}
+	r.dsts[client] = dst
+}
+
+// Resolve returns destination set for remote address of c
+func (r *FakeResolver) Resolve(c net.Conn) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := c.RemoteAddr().String()
+	dst, ok := r.dsts[client]
+	if !ok {
+		return "", fmt.Errorf("no destination for %s", client)
+	}
+	return dst, nil
+}
@@ -0,0 +1,62 @@
+package orgdst
+
+import (
+	"net"
+	"testing"
+)
+
+// tcpPair returns server side and client side of tcp connection on network
+func tcpPair(t *testing.T, network, addr string) (net.Conn, net.Conn) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial(network, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestStaticResolver(t *testing.T) {
+	server, _ := tcpPair(t, "tcp4", "127.0.0.1:0")
+	got, err := StaticResolver{Dst: "192.0.2.1:80"}.Resolve(server)
+	if err != nil || got != "192.0.2.1:80" {
+		t.Errorf("got=%s, err=%v", got, err)
+	}
+}
+
+func TestTProxyResolver(t *testing.T) {
+	server, client := tcpPair(t, "tcp4", "127.0.0.1:0")
+	got, err := TProxyResolver{}.Resolve(server)
+	if err != nil || got != client.RemoteAddr().String() {
+		t.Errorf("got=%s, err=%v", got, err)
+	}
+}
+
+func TestFakeResolver(t *testing.T) {
+	server, client := tcpPair(t, "tcp4", "127.0.0.1:0")
+	r := &FakeResolver{}
+	if _, err := r.Resolve(server); err == nil {
+		t.Error("error is not returned for unknown client")
+	}
+	r.Set(client.LocalAddr().String(), "192.0.2.1:443")
+	got, err := r.Resolve(server)
+	if err != nil || got != "192.0.2.1:443" {
+		t.Errorf("got=%s, err=%v", got, err)
+	}
+}
+
+func TestResolverFunc(t *testing.T) {
+	var r Resolver = ResolverFunc(func(c net.Conn) (string, error) { return "192.0.2.1:80", nil })
+	if got, _ := r.Resolve(nil); got != "192.0.2.1:80" {
+		t.Errorf("got=%s", got)
+	}
+}
@@ -0,0 +1,11 @@
+package orgdst
+
+import (
+	"net"
+)
+
+// GetLocalDst returns original destination of Conn accepted by TPROXY.
+// TPROXY keeps the destination, so it is the local address of Conn
+func GetLocalDst(c net.Conn) (string, error) {
+	return c.LocalAddr().String(), nil
+}
@@ -0,0 +1,11 @@
+package orgdst
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenTransparent is not supported on darwin
+func ListenTransparent(addr string) (net.Listener, error) {
+	return nil, errors.New("transparent listener is not supported")
+}
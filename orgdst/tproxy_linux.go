@@ -0,0 +1,33 @@
+package orgdst
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const ipv6Transparent = 75
+
+// ListenTransparent listens tcp with IP_TRANSPARENT for TPROXY
+func ListenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if serr != nil {
+					return
+				}
+				if network == "tcp4" {
+					return
+				}
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
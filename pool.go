@@ -0,0 +1,284 @@
+package traproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultPoolMaxIdle is default limit of idle connections in Pool
+	DefaultPoolMaxIdle = 64
+	// DefaultPoolIdleTimeout is default time to keep idle connection in Pool
+	DefaultPoolIdleTimeout = 60 * time.Second
+	// DefaultPoolWaitTimeout is default time to wait for connection over MaxPerHost
+	DefaultPoolWaitTimeout = 30 * time.Second
+)
+
+// Pool keeps idle keep-alive connections to upstream for reuse.
+// Connections from Get must be returned by Put or Discard
+type Pool struct {
+	// MaxIdle is limit of idle connections. Default is DefaultPoolMaxIdle
+	MaxIdle int
+	// MaxPerHost is limit of connections per address including connections in use.
+	// Get waits for a connection to be returned on the limit. 0 is unlimited
+	MaxPerHost int
+	// WaitTimeout is time for Get to wait on MaxPerHost. Default is DefaultPoolWaitTimeout
+	WaitTimeout time.Duration
+	// IdleTimeout is time to keep idle connection. Default is DefaultPoolIdleTimeout
+	IdleTimeout time.Duration
+	// Dial connects to upstream. Default is net.Dial
+	Dial func(addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	idle  map[string][]idleConn
+	nidle int
+	// conns is number of connections per address
+	conns map[string]int
+	// addrs is address of connections from Get
+	addrs map[net.Conn]string
+	stats PoolStats
+}
+
+// PoolStats is metrics of Pool
+type PoolStats struct {
+	// Hits is number of Get returning idle connection
+	Hits uint64
+	// Misses is number of Get dialing new connection
+	Misses uint64
+	// Stale is number of idle connections closed by upstream or timeout
+	Stale uint64
+	// Waits is number of Get waiting on MaxPerHost
+	Waits uint64
+	// WaitTimeouts is number of Get failed by WaitTimeout or cancellation while waiting
+	WaitTimeouts uint64
+	Idle         int
+	InUse        int
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func (p *Pool) init() {
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+		p.idle = map[string][]idleConn{}
+		p.conns = map[string]int{}
+		p.addrs = map[net.Conn]string{}
+	}
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	return DefaultPoolMaxIdle
+}
+
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return DefaultPoolIdleTimeout
+}
+
+func (p *Pool) waitTimeout() time.Duration {
+	if p.WaitTimeout > 0 {
+		return p.WaitTimeout
+	}
+	return DefaultPoolWaitTimeout
+}
+
+// Get returns idle connection to addr if alive, or dials new connection.
+// On MaxPerHost, it waits until WaitTimeout or ctx is done
+func (p *Pool) Get(ctx context.Context, addr string) (net.Conn, error) {
+	// timer and stop wake waiters to see timeout and cancellation
+	var timer *time.Timer
+	var stop func() bool
+	var deadline time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+			stop()
+		}
+	}()
+	p.mu.Lock()
+	p.init()
+	for {
+		for len(p.idle[addr]) > 0 {
+			conns := p.idle[addr]
+			ic := conns[len(conns)-1]
+			p.idle[addr] = conns[:len(conns)-1]
+			p.nidle--
+			if time.Since(ic.since) > p.idleTimeout() || !isAlive(ic.conn) {
+				p.stats.Stale++
+				p.release(ic.conn)
+				ic.conn.Close()
+				continue
+			}
+			p.stats.Hits++
+			p.mu.Unlock()
+			return ic.conn, nil
+		}
+		if p.MaxPerHost <= 0 || p.conns[addr] < p.MaxPerHost {
+			break
+		}
+		if timer == nil {
+			p.stats.Waits++
+			wake := func() {
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			}
+			deadline = time.Now().Add(p.waitTimeout())
+			timer = time.AfterFunc(p.waitTimeout(), wake)
+			stop = context.AfterFunc(ctx, wake)
+		}
+		err := ctx.Err()
+		if err == nil && !time.Now().Before(deadline) {
+			err = context.DeadlineExceeded
+		}
+		if err != nil {
+			p.stats.WaitTimeouts++
+			p.mu.Unlock()
+			return nil, fmt.Errorf("no connection to %s is available: %s", addr, err)
+		}
+		p.cond.Wait()
+	}
+	p.stats.Misses++
+	p.conns[addr]++
+	p.mu.Unlock()
+
+	dial := p.Dial
+	if dial == nil {
+		dial = func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+	}
+	c, err := dial(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.conns[addr]--
+		p.cond.Broadcast()
+		return nil, err
+	}
+	p.addrs[c] = addr
+	return c, nil
+}
+
+// Put returns c from Get to idle connections. c is closed if idle connections are full
+func (p *Pool) Put(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	addr, ok := p.addrs[c]
+	if !ok {
+		c.Close()
+		return
+	}
+	p.closeExpired()
+	if p.nidle >= p.maxIdle() {
+		p.release(c)
+		c.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], idleConn{conn: c, since: time.Now()})
+	p.nidle++
+	p.cond.Broadcast()
+}
+
+// Discard closes c from Get
+func (p *Pool) Discard(c net.Conn) {
+	p.mu.Lock()
+	p.init()
+	p.release(c)
+	p.mu.Unlock()
+	c.Close()
+}
+
+// CloseIdle closes all idle connections
+func (p *Pool) CloseIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	for addr, conns := range p.idle {
+		for _, ic := range conns {
+			p.release(ic.conn)
+			ic.conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+	p.nidle = 0
+}
+
+// Stats returns metrics of Pool
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Idle = p.nidle
+	s.InUse = len(p.addrs) - p.nidle
+	return s
+}
+
+// release forgets c. Caller must hold p.mu
+func (p *Pool) release(c net.Conn) {
+	addr, ok := p.addrs[c]
+	if !ok {
+		return
+	}
+	delete(p.addrs, c)
+	if p.conns[addr]--; p.conns[addr] <= 0 {
+		delete(p.conns, addr)
+	}
+	p.cond.Broadcast()
+}
+
+// closeExpired closes idle connections over IdleTimeout. Caller must hold p.mu
+func (p *Pool) closeExpired() {
+	for addr, conns := range p.idle {
+		alive := conns[:0]
+		for _, ic := range conns {
+			if time.Since(ic.since) <= p.idleTimeout() {
+				alive = append(alive, ic)
+				continue
+			}
+			p.stats.Stale++
+			p.nidle--
+			p.release(ic.conn)
+			ic.conn.Close()
+		}
+		if len(alive) == 0 {
+			delete(p.idle, addr)
+		} else {
+			p.idle[addr] = alive
+		}
+	}
+}
+
+// isAlive reports whether idle c is neither closed by peer nor has unexpected bytes
+func isAlive(c net.Conn) bool {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	alive := false
+	b := make([]byte, 1)
+	err = rc.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), b, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		alive = err == syscall.EAGAIN
+		// done without waiting for readable
+		return true
+	})
+	return err == nil && alive
+}
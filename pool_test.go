@@ -0,0 +1,217 @@
+package traproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startPoolServer starts server. Connections are closed by server if closeConn
+func startPoolServer(t *testing.T, closeConn bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if closeConn {
+				c.Close()
+				continue
+			}
+			conns = append(conns, c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestPoolReuse(t *testing.T) {
+	addr := startPoolServer(t, false)
+	p := &Pool{}
+	defer p.CloseIdle()
+
+	c1, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c1)
+	p.Put(c2)
+	if s := p.Stats(); s.Idle != 2 || s.InUse != 0 {
+		t.Errorf("stats=%+v", s)
+	}
+
+	c3, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 != c2 {
+		t.Error("last idle connection is not reused")
+	}
+	p.Discard(c3)
+	expected := PoolStats{Hits: 1, Misses: 2, Idle: 1, InUse: 0}
+	if s := p.Stats(); s != expected {
+		t.Errorf("stats=%+v", s)
+	}
+}
+
+func TestPoolClosedByPeer(t *testing.T) {
+	addr := startPoolServer(t, true)
+	p := &Pool{}
+	defer p.CloseIdle()
+
+	c, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c)
+	// wait for close by server
+	time.Sleep(20 * time.Millisecond)
+
+	c2, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Discard(c2)
+	if c2 == c {
+		t.Error("closed connection is reused")
+	}
+	if s := p.Stats(); s.Hits != 0 || s.Misses != 2 || s.Stale != 1 {
+		t.Errorf("stats=%+v", s)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	addr := startPoolServer(t, false)
+	p := &Pool{IdleTimeout: time.Millisecond}
+	defer p.CloseIdle()
+
+	c, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c)
+	time.Sleep(5 * time.Millisecond)
+	c2, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Discard(c2)
+	if c2 == c {
+		t.Error("expired connection is reused")
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	addr := startPoolServer(t, false)
+	p := &Pool{MaxIdle: 1}
+	defer p.CloseIdle()
+
+	c1, _ := p.Get(context.Background(), addr)
+	c2, _ := p.Get(context.Background(), addr)
+	p.Put(c1)
+	p.Put(c2)
+	if s := p.Stats(); s.Idle != 1 {
+		t.Errorf("stats=%+v", s)
+	}
+	if _, err := c2.Write([]byte("x")); err == nil {
+		t.Error("connection over MaxIdle is not closed")
+	}
+}
+
+func TestPoolMaxPerHost(t *testing.T) {
+	addr := startPoolServer(t, false)
+	p := &Pool{MaxPerHost: 1}
+	defer p.CloseIdle()
+
+	c1, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan net.Conn)
+	go func() {
+		c, _ := p.Get(context.Background(), addr)
+		got <- c
+	}()
+	select {
+	case <-got:
+		t.Fatal("connection over MaxPerHost is returned")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.Put(c1)
+	select {
+	case c := <-got:
+		if c != c1 {
+			t.Error("returned connection is not reused")
+		}
+		p.Discard(c)
+	case <-time.After(time.Second):
+		t.Fatal("Get is not woken by Put")
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	addr := startPoolServer(t, false)
+	p := &Pool{MaxPerHost: 1, WaitTimeout: 20 * time.Millisecond}
+	defer p.CloseIdle()
+
+	c1, err := p.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Discard(c1)
+	if _, err := p.Get(context.Background(), addr); err == nil {
+		t.Fatal("connection over MaxPerHost is returned")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := p.Get(ctx, addr)
+		errc <- err
+	}()
+	cancel()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("connection over MaxPerHost is returned")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get is not canceled")
+	}
+	if s := p.Stats(); s.Waits != 2 || s.WaitTimeouts != 2 || s.InUse != 1 {
+		t.Errorf("stats=%+v", s)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	p := &Pool{MaxPerHost: 1}
+	if _, err := p.Get(context.Background(), "127.0.0.1:1"); err == nil {
+		t.Fatal("error is not returned")
+	}
+	// failed dial does not count for MaxPerHost
+	addr := startPoolServer(t, false)
+	p.Dial = func(string) (net.Conn, error) { return net.Dial("tcp", addr) }
+	c, err := p.Get(context.Background(), "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Discard(c)
+	if s := p.Stats(); s.InUse != 0 || s.Misses != 2 {
+		t.Errorf("stats=%+v", s)
+	}
+}
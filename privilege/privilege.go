@@ -0,0 +1,11 @@
+package privilege
+
+// Cap is linux capability number
+type Cap uint
+
+// capabilities kept by Drop
+const (
+	CapNetBindService Cap = 10
+	CapNetAdmin       Cap = 12
+	CapNetRaw         Cap = 13
+)
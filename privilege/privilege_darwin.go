@@ -0,0 +1,8 @@
+package privilege
+
+import "errors"
+
+// Drop is not supported on darwin
+func Drop(uid, gid int, groups []int, caps ...Cap) error {
+	return errors.New("dropping privilege is not supported")
+}
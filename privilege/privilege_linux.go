@@ -0,0 +1,73 @@
+package privilege
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetKeepCaps     = 8
+	prCapAmbient      = 47
+	prCapAmbientRaise = 2
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// Drop changes user and groups of all threads to uid, gid and groups, and keeps only caps.
+// caps are also raised to ambient set so that executed commands such as iptables have them.
+// It requires binary built without cgo
+func Drop(uid, gid int, groups []int, caps ...Cap) error {
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0); e != 0 {
+		if e == syscall.ENOTSUP {
+			return fmt.Errorf("failed to keep capabilities: %s. build with CGO_ENABLED=0", e)
+		}
+		return fmt.Errorf("failed to keep capabilities: %s", e)
+	}
+	if groups == nil {
+		groups = []int{}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set groups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid: %s", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid: %s", err)
+	}
+
+	var data [2]capData
+	for _, c := range caps {
+		i, bit := c/32, uint32(1)<<(c%32)
+		data[i].effective |= bit
+		data[i].permitted |= bit
+		data[i].inheritable |= bit
+	}
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e != 0 {
+		return fmt.Errorf("failed to set capabilities: %s", e)
+	}
+	for _, c := range caps {
+		if _, _, e := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL,
+			prCapAmbient, prCapAmbientRaise, uintptr(c), 0, 0, 0); e != 0 {
+			return fmt.Errorf("failed to raise ambient capability %d: %s", c, e)
+		}
+	}
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 0, 0); e != 0 {
+		return fmt.Errorf("failed to reset keep capabilities: %s", e)
+	}
+	return nil
+}
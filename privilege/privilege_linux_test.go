@@ -0,0 +1,194 @@
+package privilege
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/nyushi/traproxy/firewall"
+)
+
+const nobody = 65534
+
+func TestMain(m *testing.M) {
+	if os.Getenv("PRIVILEGE_TEST_HELPER") == "iptables" {
+		os.Exit(fakeIPTables())
+	}
+	os.Exit(m.Run())
+}
+
+// fakeIPTables opens raw socket and sets SO_MARK which require CAP_NET_RAW and CAP_NET_ADMIN as iptables-legacy
+func fakeIPTables() int {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		fmt.Printf("iptables v1.8.7 (legacy): can't initialize iptables table `nat': %s (you must be root)\n", err)
+		return 3
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, 1); err != nil {
+		fmt.Printf("iptables v1.8.7 (legacy): %s (you must be root)\n", err)
+		return 3
+	}
+	return 0
+}
+
+// installFakeIPTables copies test binary as iptables executable by nobody and returns its directory
+func installFakeIPTables(t *testing.T) string {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for d := dir; d != os.TempDir() && d != "/"; d = filepath.Dir(d) {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "iptables"), b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// firewallHelper sets up firewall as root and tears it down after Drop
+func firewallHelper(caps []Cap) error {
+	os.Setenv("PATH", os.Getenv("PRIVILEGE_TEST_PATH"))
+	os.Setenv("PRIVILEGE_TEST_HELPER", "iptables")
+	fw := firewall.New(&firewall.Config{FWType: firewall.FWIPTables, Runner: firewall.ExecRunner{}})
+	if err := fw.Setup(); err != nil {
+		return fmt.Errorf("setup: %s", err)
+	}
+	if err := Drop(nobody, nobody, nil, caps...); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	return fw.Teardown()
+}
+
+// status returns fields of /proc/<pid>/task/<tid>/status
+func status(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fields := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = strings.Join(strings.Fields(kv[1]), " ")
+		}
+	}
+	return fields, s.Err()
+}
+
+// checkThreads checks credentials of all threads of process
+func checkThreads(pid string, uid string, capEff string) error {
+	tasks, err := filepath.Glob("/proc/" + pid + "/task/*/status")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		st, err := status(task)
+		if err != nil {
+			return err
+		}
+		if st["Uid"] != strings.Repeat(uid+" ", 3)+uid {
+			return fmt.Errorf("%s: Uid=%s", task, st["Uid"])
+		}
+		if st["CapEff"] != capEff || st["CapAmb"] != capEff {
+			return fmt.Errorf("%s: CapEff=%s CapAmb=%s", task, st["CapEff"], st["CapAmb"])
+		}
+	}
+	return nil
+}
+
+// TestDropHelper runs in process started by runDrop
+func TestDropHelper(t *testing.T) {
+	if os.Getenv("PRIVILEGE_TEST_HELPER") == "" {
+		t.Skip("helper process")
+	}
+	var caps []Cap
+	capEff := "0000000000000000"
+	switch os.Getenv("PRIVILEGE_TEST_HELPER") {
+	case "net_admin":
+		caps = []Cap{CapNetAdmin}
+		capEff = "0000000000001000"
+	case "firewall":
+		if err := firewallHelper([]Cap{CapNetAdmin, CapNetRaw}); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "firewall_no_raw":
+		if err := firewallHelper([]Cap{CapNetAdmin}); err == nil {
+			fmt.Println("teardown succeeded without CAP_NET_RAW")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err := Drop(nobody, nobody, nil, caps...); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := checkThreads("self", fmt.Sprint(nobody), capEff); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// executed command has the same capabilities
+	cmd := exec.Command("/bin/sh", "-c", "sleep 1")
+	if err := cmd.Start(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer cmd.Process.Kill()
+	if err := checkThreads(fmt.Sprint(cmd.Process.Pid), fmt.Sprint(nobody), capEff); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runDrop(t *testing.T, mode string) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropHelper$")
+	cmd.Env = append(os.Environ(), "PRIVILEGE_TEST_HELPER="+mode)
+	if strings.HasPrefix(mode, "firewall") {
+		cmd.Env = append(cmd.Env, "PRIVILEGE_TEST_PATH="+installFakeIPTables(t))
+	}
+	out, err := cmd.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 2 {
+		t.Skipf("drop is not available: %s", out)
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	runDrop(t, "none")
+}
+
+func TestDropKeepNetAdmin(t *testing.T) {
+	runDrop(t, "net_admin")
+}
+
+func TestDropFirewallTeardown(t *testing.T) {
+	runDrop(t, "firewall")
+}
+
+func TestDropFirewallTeardownWithoutNetRaw(t *testing.T) {
+	runDrop(t, "firewall_no_raw")
+}
@@ -2,6 +2,8 @@
 
 cd traproxy
 export GOOS=linux
+# privilege dropping requires binary without cgo
+export CGO_ENABLED=0
 for arch in amd64 386 arm; do
     GOARCH=$arch go build
     tar zcf "traproxy_linux_${arch}.tar.gz" traproxy
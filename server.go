@@ -0,0 +1,529 @@
+package traproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyushi/traproxy/orgdst"
+)
+
+// DefaultAddr is address to listen by Server.ListenAndServe
+const DefaultAddr = ":10080"
+
+// ErrServerClosed is returned by Serve after Shutdown or Close
+var ErrServerClosed = errors.New("traproxy: server closed")
+
+// Server accepts redirected connections and translates them for proxy
+type Server struct {
+	// Addr is address to listen by ListenAndServe. Default is DefaultAddr
+	Addr string
+	// Listen creates listener for ListenAndServe. Default is net.Listen
+	Listen func(addr string) (net.Listener, error)
+	// ProxyAddr is address of upstream proxy
+	ProxyAddr string
+	// Dial connects to proxy or to destination for direct connection. Default is net.Dial.
+	// It is also used by translators and Pool which have no Dial
+	Dial func(addr string) (net.Conn, error)
+	// Resolver returns original destination of client. Default is orgdst.DefaultResolver()
+	Resolver orgdst.Resolver
+	// NewTranslator returns translator for connection. Default is DefaultTranslator
+	NewTranslator func(base TranslatorBase, direct bool) Translator
+	// LookupName returns host name of destination address if known
+	LookupName func(dst string) string
+	// Exclude reports whether connection to host name bypasses proxy
+	Exclude func(name string) bool
+	// SniffName reads host name in Host header or SNI from client for Exclude
+	SniffName bool
+	// Pool is used for connections to proxy for http if set. Serve sets Pool.Dial to Dial if nil
+	Pool *Pool
+	// Heartbeat is interval for Serve to wake from Accept and record liveness for Alive.
+	// 0 disables it
+	Heartbeat time.Duration
+
+	mu sync.Mutex
+	// listeners is last time each listener is seen alive by Serve
+	listeners map[net.Listener]time.Time
+	conns     map[*serverConn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+	state     ServerState
+	accepted  uint64
+	drained   int
+	killed    int
+	// onShutdown is called at Shutdown after listeners are closed
+	onShutdown []func()
+	// ctx is canceled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	lastID uint64
+}
+
+// ServerState is state of Server for shutdown
+type ServerState string
+
+const (
+	// StateServing is accepting connections
+	StateServing ServerState = "serving"
+	// StateDraining is waiting for connections to finish by Shutdown
+	StateDraining ServerState = "draining"
+	// StateClosed is finished
+	StateClosed ServerState = "closed"
+)
+
+// ServerStats is metrics of Server
+type ServerStats struct {
+	State ServerState
+	// Active is number of connections in translation
+	Active int
+	// Accepted is number of accepted connections
+	Accepted uint64
+	// Drained is number of connections finished while draining
+	Drained int
+	// Killed is number of connections closed by Close
+	Killed int
+}
+
+// Drainer is Translator which can finish connection before client closes it
+type Drainer interface {
+	// Drain closes connection when no request is in progress
+	Drain()
+}
+
+// serverConn is client and proxy connection in translation
+type serverConn struct {
+	id     uint64
+	mu     sync.Mutex
+	client net.Conn
+	proxy  net.Conn
+	closed bool
+	// drain is Drain of translator. It is guarded by Server.mu
+	drain func()
+}
+
+// setProxy sets proxy to be closed with client. It returns false if already closed
+func (c *serverConn) setProxy(proxy net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxy = proxy
+	return !c.closed
+}
+
+// close closes sockets and reports whether c is not closed yet
+func (c *serverConn) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	c.client.Close()
+	if c.proxy != nil {
+		c.proxy.Close()
+	}
+	return true
+}
+
+// killed reports whether c is closed by Server
+func (c *serverConn) killed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// DefaultTranslator returns translator by port of destination
+func DefaultTranslator(base TranslatorBase, direct bool) Translator {
+	if direct {
+		return &DirectTranslator{TranslatorBase: base}
+	}
+	if _, port, _ := net.SplitHostPort(base.Dst); port == "80" {
+		return &HTTPTranslator{TranslatorBase: base}
+	}
+	return &HTTPSTranslator{TranslatorBase: base}
+}
+
+// ListenAndServe listens on Addr and serves connections
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	listen := s.Listen
+	if listen == nil {
+		listen = func(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and translates them. ln is closed on return
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	s.mu.Lock()
+	if s.Pool != nil && s.Pool.Dial == nil && s.Dial != nil {
+		s.Pool.Dial = s.Dial
+	}
+	s.mu.Unlock()
+
+	dl, _ := ln.(interface{ SetDeadline(time.Time) error })
+	for {
+		s.beat(ln)
+		if dl != nil && s.Heartbeat > 0 {
+			dl.SetDeadline(time.Now().Add(s.Heartbeat))
+		}
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && dl != nil && s.Heartbeat > 0 {
+				continue
+			}
+			if isRecoverable(err) {
+				continue
+			}
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		sc := &serverConn{client: c, id: atomic.AddUint64(&s.lastID, 1)}
+		if !s.trackConn(sc, true) {
+			c.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.wg.Done()
+			defer s.trackConn(sc, false)
+			s.handle(sc)
+		}()
+	}
+}
+
+// RegisterOnShutdown registers f called at Shutdown after listeners are closed
+// and before waiting for connections
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Shutdown stops accepting connections and waits for connections to finish.
+// Translators implementing Drainer close idle connections after RegisterOnShutdown hooks.
+// It returns ctx.Err() if ctx is done first. Connections are not closed then, and Close closes them
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.state != StateClosed {
+		s.state = StateDraining
+	}
+	hooks := s.onShutdown
+	s.onShutdown = nil
+	s.mu.Unlock()
+
+	s.closeListeners()
+	for _, f := range hooks {
+		f()
+	}
+	for _, f := range s.drains() {
+		f()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.mu.Lock()
+		s.state = StateClosed
+		s.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drains returns Drain of translators
+func (s *Server) drains() []func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs := []func(){}
+	for c := range s.conns {
+		if c.drain != nil {
+			fs = append(fs, c.drain)
+		}
+	}
+	return fs
+}
+
+// setDrain sets f as Drain of c. f is called now if Server is draining
+func (s *Server) setDrain(c *serverConn, f func()) {
+	s.mu.Lock()
+	c.drain = f
+	draining := s.state == StateDraining
+	s.mu.Unlock()
+	if draining {
+		f()
+	}
+}
+
+// Close stops accepting connections and closes all connections
+func (s *Server) Close() error {
+	s.closeListeners()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = StateClosed
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for c := range s.conns {
+		if c.close() {
+			s.killed++
+		}
+	}
+	return nil
+}
+
+// Stats returns metrics of Server
+func (s *Server) Stats() ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := ServerStats{
+		State:    s.state,
+		Active:   len(s.conns),
+		Accepted: s.accepted,
+		Drained:  s.drained,
+		Killed:   s.killed,
+	}
+	if st.State == "" {
+		st.State = StateServing
+	}
+	return st
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// Alive returns error if Server is not serving, or Serve of a listener has not
+// run for twice of Heartbeat such as hung by deadlock
+func (s *Server) Alive() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.listeners) == 0 {
+		return errors.New("traproxy: server is not serving")
+	}
+	if s.Heartbeat <= 0 {
+		return nil
+	}
+	for ln, t := range s.listeners {
+		if d := time.Since(t); d > 2*s.Heartbeat {
+			return fmt.Errorf("traproxy: listener %s is not served for %s", ln.Addr(), d)
+		}
+	}
+	return nil
+}
+
+// beat records ln is served now
+func (s *Server) beat(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.listeners[ln]; ok {
+		s.listeners[ln] = time.Now()
+	}
+}
+
+// trackListener adds or removes ln. It returns false if server is closed
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]time.Time{}
+	}
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.listeners[ln] = time.Now()
+	return true
+}
+
+// trackConn adds or removes c. It returns false if server is closed
+func (s *Server) trackConn(c *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = map[*serverConn]struct{}{}
+	}
+	if !add {
+		if _, ok := s.conns[c]; ok && s.state == StateDraining {
+			s.drained++
+		}
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.accepted++
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) dial(addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+func (s *Server) resolve(c net.Conn) (string, error) {
+	if s.Resolver != nil {
+		return s.Resolver.Resolve(c)
+	}
+	return orgdst.DefaultResolver().Resolve(c)
+}
+
+func (s *Server) lookupName(dst string) string {
+	if s.LookupName == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(dst)
+	if err != nil {
+		return ""
+	}
+	return s.LookupName(host)
+}
+
+func (s *Server) exclude(name string) bool {
+	return name != "" && s.Exclude != nil && s.Exclude(name)
+}
+
+// handle translates connection from client
+func (s *Server) handle(sc *serverConn) {
+	client := sc.client
+	defer client.Close()
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("%s: %s", e, debug.Stack())
+		}
+	}()
+
+	dst, err := s.resolve(client)
+	if err != nil {
+		log.Printf("#%d %s", sc.id, err)
+		return
+	}
+	name := s.lookupName(dst)
+	direct := s.exclude(name)
+	var buffered []byte
+	if !direct && s.SniffName {
+		var sniffed string
+		buffered, sniffed, err = SniffHostName(client)
+		if err != nil {
+			log.Printf("#%d failed to read from client: %s", sc.id, err)
+			return
+		}
+		direct = s.exclude(sniffed)
+		if sniffed != "" {
+			name = sniffed
+		}
+	}
+	log.Printf("#%d %s %s", sc.id, dst, name)
+
+	upstream := s.ProxyAddr
+	if direct {
+		upstream = dst
+	}
+	_, port, _ := net.SplitHostPort(dst)
+	// HTTPTranslator returns pooled connection
+	usePool := s.Pool != nil && !direct && port == "80"
+	var proxy net.Conn
+	if usePool {
+		proxy, err = s.Pool.Get(s.ctx, upstream)
+	} else {
+		proxy, err = s.dial(upstream)
+	}
+	if err != nil {
+		log.Printf("#%d failed to connect proxy: %s", sc.id, err)
+		return
+	}
+	release := func() { proxy.Close() }
+	if usePool {
+		release = func() { s.Pool.Discard(proxy) }
+	}
+	if !sc.setProxy(proxy) {
+		release()
+		return
+	}
+
+	base := TranslatorBase{
+		Client:   client,
+		Proxy:    proxy,
+		Dst:      dst,
+		DstName:  name,
+		Buffered: buffered,
+		ID:       sc.id,
+	}
+	newTranslator := s.NewTranslator
+	if newTranslator == nil {
+		newTranslator = DefaultTranslator
+	}
+	t := newTranslator(base, direct)
+	switch tt := t.(type) {
+	case *HTTPTranslator:
+		if tt.Dial == nil {
+			tt.Dial = s.dial
+		}
+	case *H2CTranslator:
+		if tt.Dial == nil {
+			tt.Dial = s.dial
+		}
+	}
+	if d, ok := t.(Drainer); ok {
+		s.setDrain(sc, d.Drain)
+	}
+	if ht, ok := t.(*HTTPTranslator); ok && usePool {
+		ht.Pool = s.Pool
+	} else {
+		defer release()
+	}
+
+	r, err := t.Start(s.ctx)
+	if err != nil {
+		base.Logf("%s", err)
+	}
+	if sc.killed() {
+		// sockets may be closed by Close before translator sees cancellation
+		r.CloseReason = CloseCanceled
+	}
+	base.Logf("%s", r)
+}
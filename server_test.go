@@ -0,0 +1,349 @@
+package traproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyushi/traproxy/orgdst"
+)
+
+// startServer serves s on local address and returns address and result of Serve
+func startServer(t *testing.T, s *Server) (string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ln)
+	}()
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), served
+}
+
+func TestServerServe(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	addr, _ := startServer(t, &Server{ProxyAddr: proxyAddr, Resolver: orgdst.StaticResolver{Dst: "192.0.2.1:80"}})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if got := readResponseBodies(t, c, 1); got[0] != "http://example.com/x" {
+		t.Errorf("got=%s", got[0])
+	}
+}
+
+func TestServerExclude(t *testing.T) {
+	originAddr, _ := startRouteProxy(t, false)
+	addr, _ := startServer(t, &Server{
+		ProxyAddr: "127.0.0.1:1",
+		Resolver:  orgdst.StaticResolver{Dst: originAddr},
+		Exclude:   func(name string) bool { return name == "example.com" },
+		SniffName: true,
+	})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	// request is sent to destination as is
+	if got := readResponseBodies(t, c, 1); got[0] != "/x" {
+		t.Errorf("got=%s", got[0])
+	}
+}
+
+func TestServerNewTranslator(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	var created int32
+	addr, _ := startServer(t, &Server{
+		ProxyAddr: proxyAddr,
+		Resolver:  orgdst.StaticResolver{Dst: "192.0.2.1:80"},
+		NewTranslator: func(base TranslatorBase, direct bool) Translator {
+			atomic.AddInt32(&created, 1)
+			return &HTTPTranslator{TranslatorBase: base, HeaderRules: []HeaderRule{ViaRule()}}
+		},
+	})
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	readResponseBodies(t, c, 1)
+	if n := atomic.LoadInt32(&created); n != 1 {
+		t.Errorf("created=%d", n)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	s := &Server{ProxyAddr: proxyAddr, Resolver: orgdst.StaticResolver{Dst: "192.0.2.1:80"}}
+	addr, served := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	readResponseBodies(t, c, 1)
+	// response is delayed by proxy
+	c.Write([]byte("GET /y HTTP/1.1\r\nHost: slow.example\r\n\r\n"))
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err=%v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("err=%v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("listener is not closed")
+	}
+
+	if st := s.Stats(); st.State != StateDraining || st.Active != 1 {
+		t.Errorf("stats=%+v", st)
+	}
+
+	// connection is closed after the response in progress
+	if got := readResponseBodies(t, c, 1); got[0] != "http://slow.example/y" {
+		t.Errorf("got=%s", got[0])
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("err=%v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("err=%v", err)
+	}
+	if st := s.Stats(); st.State != StateClosed || st.Accepted != 1 || st.Drained != 1 || st.Killed != 0 {
+		t.Errorf("stats=%+v", st)
+	}
+}
+
+func TestServerShutdownIdle(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	s := &Server{ProxyAddr: proxyAddr, Resolver: orgdst.StaticResolver{Dst: "192.0.2.1:80"}}
+	addr, _ := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	readResponseBodies(t, c, 1)
+
+	// idle keep-alive connection is closed by Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("err=%v", err)
+	}
+	if st := s.Stats(); st.State != StateClosed || st.Drained != 1 || st.Killed != 0 {
+		t.Errorf("stats=%+v", st)
+	}
+}
+
+func TestServerRegisterOnShutdown(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	s := &Server{ProxyAddr: proxyAddr, Resolver: orgdst.StaticResolver{Dst: "192.0.2.1:80"}}
+	addr, _ := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	readResponseBodies(t, c, 1)
+
+	called := 0
+	s.RegisterOnShutdown(func() {
+		called++
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Error("listener is not closed before hook")
+		}
+		// connection is still served
+		c.Write([]byte("GET /y HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		if got := readResponseBodies(t, c, 1); got[0] != "http://example.com/y" {
+			t.Errorf("got=%s", got[0])
+		}
+		c.Close()
+	})
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("err=%v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("err=%v", err)
+	}
+	if called != 1 {
+		t.Errorf("called=%d", called)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	s := &Server{ProxyAddr: proxyAddr, Resolver: orgdst.StaticResolver{Dst: "192.0.2.1:80"}}
+	addr, served := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	readResponseBodies(t, c, 1)
+
+	s.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("err=%v", err)
+	}
+	if st := s.Stats(); st.State != StateClosed || st.Killed != 1 {
+		t.Errorf("stats=%+v", st)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection is not closed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(ln); err != ErrServerClosed {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestServerPool(t *testing.T) {
+	proxyAddr, conns := startRouteProxy(t, false)
+	p := &Pool{}
+	defer p.CloseIdle()
+	addr, _ := startServer(t, &Server{ProxyAddr: proxyAddr, Resolver: orgdst.StaticResolver{Dst: "192.0.2.1:80"}, Pool: p})
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("GET /x HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		readResponseBodies(t, c, 1)
+		c.Close()
+		// wait for returning to pool
+		WaitForCond(func() (bool, error) { return p.Stats().InUse == 0, nil }, time.Second)
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("connections=%d", n)
+	}
+}
+
+func TestServerDial(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	var dials int32
+	dial := func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		// proxy is reachable only by Dial
+		return net.Dial("tcp", proxyAddr)
+	}
+	newTranslator := func(base TranslatorBase, direct bool) Translator {
+		return &HTTPTranslator{TranslatorBase: base, Router: RouteEachRequest}
+	}
+	addr, _ := startServer(t, &Server{
+		ProxyAddr:     "proxy.invalid:3128",
+		Dial:          dial,
+		Resolver:      orgdst.StaticResolver{Dst: "192.0.2.1:80"},
+		NewTranslator: newTranslator,
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\nGET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if got := readResponseBodies(t, c, 2); got[1] != "http://example.com/b" {
+		t.Errorf("got=%v", got)
+	}
+	if n := atomic.LoadInt32(&dials); n < 2 {
+		t.Errorf("dials=%d", n)
+	}
+
+	// Pool dials by Server.Dial
+	p := &Pool{}
+	defer p.CloseIdle()
+	addr, _ = startServer(t, &Server{
+		ProxyAddr: "proxy.invalid:3128",
+		Dial:      dial,
+		Resolver:  orgdst.StaticResolver{Dst: "192.0.2.1:80"},
+		Pool:      p,
+	})
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.Write([]byte("GET /c HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if got := readResponseBodies(t, c2, 1); got[0] != "http://example.com/c" {
+		t.Errorf("got=%v", got)
+	}
+}
+
+// blockListener is net.Listener whose Accept blocks without deadline like hung accept loop
+type blockListener struct {
+	net.Listener
+	closed chan struct{}
+}
+
+func (l *blockListener) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *blockListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func TestServerAlive(t *testing.T) {
+	s := &Server{Heartbeat: 10 * time.Millisecond}
+	if err := s.Alive(); err == nil {
+		t.Error("server is alive before Serve")
+	}
+	startServer(t, s)
+	WaitForCond(func() (bool, error) { return s.Alive() == nil, nil }, time.Second)
+	// Serve wakes from Accept by heartbeat
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Alive(); err != nil {
+		t.Error(err)
+	}
+
+	// Serve of listener without deadline is not seen alive
+	hung := &Server{Heartbeat: 10 * time.Millisecond}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go hung.Serve(&blockListener{Listener: ln, closed: make(chan struct{})})
+	defer hung.Close()
+	if err := WaitForCond(func() (bool, error) { return hung.Alive() != nil, nil }, time.Second); err != nil {
+		t.Error("hung server is alive")
+	}
+
+	s.Close()
+	if err := s.Alive(); err == nil {
+		t.Error("closed server is alive")
+	}
+}
@@ -0,0 +1,176 @@
+package traproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nyushi/traproxy/http"
+)
+
+// SniffTimeout is timeout for reading the beginning of client stream
+var SniffTimeout = 3 * time.Second
+
+const maxSniffSize = 16384
+
+var errNotClientHello = errors.New("not tls client hello")
+
+// SniffHostName reads the beginning of client stream and returns read bytes
+// and host name in http Host header or tls server name indication
+func SniffHostName(c net.Conn) ([]byte, string, error) {
+	c.SetReadDeadline(time.Now().Add(SniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	buf := []byte{}
+	rb := make([]byte, 4096)
+	for len(buf) < maxSniffSize {
+		n, err := c.Read(rb)
+		buf = append(buf, rb[:n]...)
+		if name, ok := ParseHostName(buf); ok {
+			return buf, name, nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return buf, "", nil
+			}
+			return buf, "", err
+		}
+	}
+	return buf, "", nil
+}
+
+// ParseHostName returns host name from http request or tls client hello.
+// ok is false if b is not enough to find host name
+func ParseHostName(b []byte) (string, bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+	if b[0] == 0x16 {
+		name, ok, err := ParseSNI(b)
+		if err != nil {
+			return "", true
+		}
+		return name, ok
+	}
+	_, req, err := http.ReadRequestHeader(b)
+	if err != nil {
+		return "", true
+	}
+	if req == nil {
+		return "", false
+	}
+	// authority in request-target takes precedence over Host
+	b, ok := req.Authority()
+	if !ok {
+		b, ok = req.Header("Host")
+	}
+	if !ok {
+		return "", true
+	}
+	host := string(b)
+	if hh, _, err := net.SplitHostPort(host); err == nil {
+		host = hh
+	}
+	return strings.ToLower(host), true
+}
+
+// ParseSNI returns server name in tls client hello.
+// ok is false if b is not enough to find server name
+func ParseSNI(b []byte) (name string, ok bool, err error) {
+	if len(b) < 5 {
+		return "", false, nil
+	}
+	if b[0] != 0x16 {
+		return "", true, errNotClientHello
+	}
+	recLen := int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < 5+recLen {
+		return "", false, nil
+	}
+	p := b[5 : 5+recLen]
+
+	// handshake header
+	if len(p) < 4 || p[0] != 0x01 {
+		return "", true, errNotClientHello
+	}
+	p = p[4:]
+
+	// version, random
+	if len(p) < 34 {
+		return "", true, errNotClientHello
+	}
+	p = p[34:]
+
+	// session id
+	if p, err = skipVector(p, 1); err != nil {
+		return "", true, err
+	}
+	// cipher suites
+	if p, err = skipVector(p, 2); err != nil {
+		return "", true, err
+	}
+	// compression methods
+	if p, err = skipVector(p, 1); err != nil {
+		return "", true, err
+	}
+	if len(p) < 2 {
+		// no extensions
+		return "", true, nil
+	}
+	extLen := int(binary.BigEndian.Uint16(p[0:2]))
+	p = p[2:]
+	if len(p) < extLen {
+		return "", true, errNotClientHello
+	}
+	p = p[:extLen]
+	for len(p) >= 4 {
+		typ := binary.BigEndian.Uint16(p[0:2])
+		l := int(binary.BigEndian.Uint16(p[2:4]))
+		p = p[4:]
+		if len(p) < l {
+			return "", true, errNotClientHello
+		}
+		if typ == 0 {
+			return parseServerNameExtension(p[:l])
+		}
+		p = p[l:]
+	}
+	return "", true, nil
+}
+
+func skipVector(p []byte, lenSize int) ([]byte, error) {
+	if len(p) < lenSize {
+		return nil, errNotClientHello
+	}
+	l := 0
+	for _, v := range p[:lenSize] {
+		l = l<<8 | int(v)
+	}
+	p = p[lenSize:]
+	if len(p) < l {
+		return nil, errNotClientHello
+	}
+	return p[l:], nil
+}
+
+func parseServerNameExtension(p []byte) (string, bool, error) {
+	if len(p) < 2 {
+		return "", true, errNotClientHello
+	}
+	p = p[2:]
+	for len(p) >= 3 {
+		typ := p[0]
+		l := int(binary.BigEndian.Uint16(p[1:3]))
+		p = p[3:]
+		if len(p) < l {
+			return "", true, errNotClientHello
+		}
+		if typ == 0 {
+			return strings.ToLower(string(p[:l])), true, nil
+		}
+		p = p[l:]
+	}
+	return "", true, nil
+}
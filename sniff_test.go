@@ -0,0 +1,107 @@
+package traproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func getClientHello(t *testing.T, serverName string) []byte {
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		defer a.Close()
+		c := tls.Client(a, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		c.Handshake()
+	}()
+	buf := make([]byte, 4096)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestParseSNI(t *testing.T) {
+	hello := getClientHello(t, "WWW.Example.com")
+	name, ok, err := ParseSNI(hello)
+	if err != nil || !ok || name != "www.example.com" {
+		t.Errorf("failed to parse sni: name=%s, ok=%v, err=%v", name, ok, err)
+	}
+
+	_, ok, err = ParseSNI(hello[:len(hello)-1])
+	if err != nil || ok {
+		t.Errorf("partial client hello: ok=%v, err=%v", ok, err)
+	}
+
+	_, _, err = ParseSNI([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if err == nil {
+		t.Error("error not returned")
+	}
+}
+
+var parseHostNameTests = []struct {
+	in   string
+	name string
+	ok   bool
+}{
+	{"", "", false},
+	{"GET / HTTP/1.1\r\nHost: Example.com:8080\r\n", "", false},
+	{"GET / HTTP/1.1\r\nHost: Example.com:8080\r\n\r\n", "example.com", true},
+	{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", true},
+	{"GET / HTTP/1.0\r\n\r\n", "", true},
+	{"GET http://user@Example.org:8080/a HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.org", true},
+	{"CONNECT example.org:80 HTTP/1.1\r\nHost: example.org:80\r\n\r\n", "example.org", true},
+}
+
+func TestParseHostName(t *testing.T) {
+	for _, v := range parseHostNameTests {
+		name, ok := ParseHostName([]byte(v.in))
+		if name != v.name || ok != v.ok {
+			t.Errorf("%q: got=(%s, %v), expected=(%s, %v)", v.in, name, ok, v.name, v.ok)
+		}
+	}
+	name, ok := ParseHostName(getClientHello(t, "example.com"))
+	if name != "example.com" || !ok {
+		t.Errorf("got=(%s, %v)", name, ok)
+	}
+}
+
+func TestSniffHostName(t *testing.T) {
+	s, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.A.Close()
+	defer s.B.Close()
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nbody"
+	go func() {
+		s.B.Write([]byte(req[:10]))
+		time.Sleep(10 * time.Millisecond)
+		s.B.Write([]byte(req[10:]))
+	}()
+	buf, name, err := SniffHostName(s.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "example.com" {
+		t.Errorf("invalid name: %s", name)
+	}
+	if string(buf) != req[:len(buf)] {
+		t.Errorf("invalid buffered bytes: %s", string(buf))
+	}
+
+	orig := SniffTimeout
+	defer func() { SniffTimeout = orig }()
+	SniffTimeout = 10 * time.Millisecond
+	buf, name, err = SniffHostName(s.A)
+	if err != nil || name != "" {
+		t.Errorf("timeout is not handled: name=%s, err=%v", name, err)
+	}
+	if string(buf) != req[len(req)-len(buf):] {
+		t.Errorf("invalid buffered bytes: %s", string(buf))
+	}
+}
@@ -0,0 +1,125 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// states sent by Notify
+const (
+	Ready        = "READY=1"
+	Stopping     = "STOPPING=1"
+	WatchdogPing = "WATCHDOG=1"
+)
+
+// listenFdsStart is the first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+// Listeners returns listeners passed by socket activation.
+// It returns no listeners if the process is not activated by socket
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+	return fileListeners(listenFdsStart, n, names)
+}
+
+// fileListeners returns listeners of n file descriptors from first
+func fileListeners(first, n int, names []string) ([]net.Listener, error) {
+	lns := []net.Listener{}
+	for fd := first; fd < first+n; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - first; i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %d is not listener: %s", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// Notify sends state to service manager by NOTIFY_SOCKET.
+// It returns false if the service is not run with notify
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns interval required by service manager between watchdog pings.
+// It returns 0 if watchdog is not enabled
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC: " + strconv.Quote(s))
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// Watchdog sends watchdog pings at half of interval until stop is closed.
+// Pings are skipped while check returns error, so that service manager restarts hung service
+func Watchdog(interval time.Duration, check func() error, stop <-chan struct{}) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if err := check(); err != nil {
+			log.Printf("skip watchdog ping: %s", err)
+		} else if _, err := Notify(WatchdogPing); err != nil {
+			log.Printf("failed to send watchdog ping: %s", err)
+		}
+	}
+}
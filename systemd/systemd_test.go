@@ -0,0 +1,211 @@
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens notify socket and sets NOTIFY_SOCKET
+func fakeNotifySocket(t *testing.T, name string) *net.UnixConn {
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if name[0] == '\x00' {
+		name = "@" + name[1:]
+	}
+	t.Setenv("NOTIFY_SOCKET", name)
+	return c
+}
+
+func readState(t *testing.T, c *net.UnixConn) string {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	c := fakeNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	for _, state := range []string{Ready, Stopping} {
+		ok, err := Notify(state)
+		if !ok || err != nil {
+			t.Fatalf("ok=%t err=%v", ok, err)
+		}
+		if got := readState(t, c); got != state {
+			t.Errorf("got=%q", got)
+		}
+	}
+}
+
+func TestNotifyAbstract(t *testing.T) {
+	c := fakeNotifySocket(t, "\x00traproxy-test-"+strconv.Itoa(os.Getpid()))
+	if ok, err := Notify(Ready); !ok || err != nil {
+		t.Fatalf("ok=%t err=%v", ok, err)
+	}
+	if got := readState(t, c); got != Ready {
+		t.Errorf("got=%q", got)
+	}
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify(Ready); ok || err != nil {
+		t.Errorf("ok=%t err=%v", ok, err)
+	}
+}
+
+func TestNotifyError(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "notify"))
+	if ok, err := Notify(Ready); ok || err == nil {
+		t.Errorf("ok=%t err=%v", ok, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, c := range []struct {
+		usec, pid string
+		expected  time.Duration
+		err       bool
+	}{
+		{"", "", 0, false},
+		{"30000000", "", 30 * time.Second, false},
+		{"30000000", pid, 30 * time.Second, false},
+		{"30000000", "1", 0, false},
+		{"x", "", 0, true},
+		{"0", "", 0, true},
+	} {
+		t.Setenv("WATCHDOG_USEC", c.usec)
+		t.Setenv("WATCHDOG_PID", c.pid)
+		d, err := WatchdogInterval()
+		if d != c.expected || (err != nil) != c.err {
+			t.Errorf("usec=%s pid=%s: interval=%s err=%v", c.usec, c.pid, d, err)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	c := fakeNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Watchdog(20*time.Millisecond, func() error { return nil }, stop)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		if got := readState(t, c); got != WatchdogPing {
+			t.Errorf("got=%q", got)
+		}
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog is not stopped")
+	}
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	c := fakeNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	var healthy atomic.Bool
+	stop := make(chan struct{})
+	defer close(stop)
+	go Watchdog(20*time.Millisecond, func() error {
+		if !healthy.Load() {
+			return errors.New("hung")
+		}
+		return nil
+	}, stop)
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := c.Read(make([]byte, 1024)); err == nil {
+		t.Fatalf("ping is sent while check fails: %d bytes", n)
+	}
+	healthy.Store(true)
+	if got := readState(t, c); got != WatchdogPing {
+		t.Errorf("got=%q", got)
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	lns, err := Listeners()
+	if len(lns) != 0 || err != nil {
+		t.Errorf("listeners=%v err=%v", lns, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS is not unset")
+	}
+}
+
+func TestListenersInvalid(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "x")
+	if _, err := Listeners(); err == nil {
+		t.Error("no error")
+	}
+}
+
+// dupFd returns file descriptor of f owned by caller, and closes f
+func dupFd(t *testing.T, f *os.File) int {
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestFileListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lns, err := fileListeners(dupFd(t, f), 1, []string{"traproxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 1 || lns[0].Addr().String() != ln.Addr().String() {
+		t.Fatalf("listeners=%v", lns)
+	}
+	defer lns[0].Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := lns[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestFileListenersNotSocket(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileListeners(dupFd(t, f), 1, nil); err == nil {
+		t.Error("no error")
+	}
+}
@@ -1,15 +1,59 @@
 package traproxy
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 )
 
-// Translator is the interface that wraps the proxy translation
+// Translator is the interface that wraps the proxy translation.
+// Start blocks until translation is finished. Sockets are closed if ctx is done
 type Translator interface {
-	Start() error
+	Start(ctx context.Context) (Result, error)
+}
+
+// CloseReason is why translation is finished
+type CloseReason string
+
+const (
+	// CloseClient is closed by client first
+	CloseClient CloseReason = "client closed"
+	// CloseUpstream is closed by proxy or destination first
+	CloseUpstream CloseReason = "upstream closed"
+	// CloseCanceled is closed by cancellation of context
+	CloseCanceled CloseReason = "canceled"
+	// CloseRejected is closed by rejecting request from client
+	CloseRejected CloseReason = "rejected"
+	// CloseDrained is closed by Drain with no request in progress
+	CloseDrained CloseReason = "drained"
+	// CloseError is closed by error of translation
+	CloseError CloseReason = "error"
+)
+
+// Result is summary of translation
+type Result struct {
+	// ID is ID of connection
+	ID uint64
+	// Sent is bytes read from client
+	Sent int64
+	// Received is bytes read from upstream
+	Received int64
+	// Requests is number of http requests
+	Requests int
+	// CloseReason is why translation is finished
+	CloseReason CloseReason
+	// UpstreamStatus is status code of CONNECT or the last http response. 0 if none
+	UpstreamStatus int
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%s: sent=%d received=%d requests=%d status=%d",
+		r.CloseReason, r.Sent, r.Received, r.Requests, r.UpstreamStatus)
 }
 
 // TranslatorBase contains client/proxy socket and destination
@@ -17,6 +61,137 @@ type TranslatorBase struct {
 	Client net.Conn
 	Proxy  net.Conn
 	Dst    string
+	// DstName is host name of Dst if known
+	DstName string
+	// Buffered is bytes already read from Client
+	Buffered []byte
+	// ID identifies connection in logs
+	ID uint64
+
+	// stats is shared with translator taking over the connection
+	stats *connStats
+}
+
+// connStats is counters for Result
+type connStats struct {
+	sent, received, requests, status int64
+
+	once   sync.Once
+	reason CloseReason
+}
+
+// start prepares Result and calls abort when ctx is done. Default abort closes sockets.
+// Returned stop must be called when translation is finished
+func (t *TranslatorBase) start(ctx context.Context, abort func()) (stop func() bool) {
+	if t.stats == nil {
+		t.stats = &connStats{}
+	}
+	if abort == nil {
+		abort = t.closeSockets
+	}
+	return context.AfterFunc(ctx, func() {
+		t.closeWith(CloseCanceled)
+		abort()
+	})
+}
+
+func (t *TranslatorBase) closeSockets() {
+	t.Client.Close()
+	t.Proxy.Close()
+}
+
+// closeWith sets reason of close if not set yet
+func (t *TranslatorBase) closeWith(reason CloseReason) {
+	if t.stats == nil {
+		return
+	}
+	t.stats.once.Do(func() { t.stats.reason = reason })
+}
+
+func (t *TranslatorBase) addSent(n int) {
+	if t.stats != nil {
+		atomic.AddInt64(&t.stats.sent, int64(n))
+	}
+}
+
+func (t *TranslatorBase) addReceived(n int) {
+	if t.stats != nil {
+		atomic.AddInt64(&t.stats.received, int64(n))
+	}
+}
+
+func (t *TranslatorBase) addRequests(n int) {
+	if t.stats != nil {
+		atomic.AddInt64(&t.stats.requests, int64(n))
+	}
+}
+
+func (t *TranslatorBase) setUpstreamStatus(code int) {
+	if t.stats != nil {
+		atomic.StoreInt64(&t.stats.status, int64(code))
+	}
+}
+
+// counters returns counters of sent and received bytes for pipe
+func (t *TranslatorBase) counters() (sent, received *int64) {
+	if t.stats == nil {
+		return nil, nil
+	}
+	return &t.stats.sent, &t.stats.received
+}
+
+// result returns Result of translation finished with err
+func (t *TranslatorBase) result(err error) (Result, error) {
+	if err != nil {
+		t.closeWith(CloseError)
+	}
+	r := Result{ID: t.ID}
+	if t.stats != nil {
+		// synchronizes with closeWith
+		t.stats.once.Do(func() {})
+		r.Sent = atomic.LoadInt64(&t.stats.sent)
+		r.Received = atomic.LoadInt64(&t.stats.received)
+		r.Requests = int(atomic.LoadInt64(&t.stats.requests))
+		r.UpstreamStatus = int(atomic.LoadInt64(&t.stats.status))
+		r.CloseReason = t.stats.reason
+	}
+	return r, err
+}
+
+// Logf logs with ID and destination of connection
+func (t *TranslatorBase) Logf(format string, v ...interface{}) {
+	prefix := t.Dst
+	if t.ID != 0 {
+		prefix = fmt.Sprintf("#%d %s", t.ID, t.Dst)
+	}
+	log.Printf("%s: %s", prefix, fmt.Sprintf(format, v...))
+}
+
+// WriteBuffered writes Buffered to Proxy through filter f
+func (t *TranslatorBase) WriteBuffered(f func([]byte) []byte) error {
+	if len(t.Buffered) == 0 {
+		return nil
+	}
+	b := t.Buffered
+	t.Buffered = nil
+	t.addSent(len(b))
+	if f != nil {
+		b = f(b)
+	}
+	_, err := t.Proxy.Write(b)
+	return err
+}
+
+// DstHostPort returns destination using DstName if known
+func (t *TranslatorBase) DstHostPort() string {
+	if t.DstName == "" {
+		return t.Dst
+	}
+	_, port, err := net.SplitHostPort(t.Dst)
+	if err != nil {
+		return t.Dst
+	}
+	return net.JoinHostPort(t.DstName, port)
 }
 
 // CheckSockets check Conn and returns TCPConn
@@ -32,6 +207,28 @@ func (t *TranslatorBase) CheckSockets() (*net.TCPConn, *net.TCPConn, error) {
 	return client, proxy, nil
 }
 
+// pipeBoth bridges client and proxy through filters until both directions are finished
+func (t *TranslatorBase) pipeBoth(client, proxy *net.TCPConn, request, response *func([]byte) []byte) {
+	sent, received := t.counters()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer t.HandlePanic()
+
+		pipe(client, proxy, response, received)
+		t.closeWith(CloseUpstream)
+	}()
+	go func() {
+		defer wg.Done()
+		defer t.HandlePanic()
+
+		pipe(proxy, client, request, sent)
+		t.closeWith(CloseClient)
+	}()
+	wg.Wait()
+}
+
 // HandlePanic is utility for recovering panic in goroutine
 func (t *TranslatorBase) HandlePanic() {
 	if e := recover(); e != nil {
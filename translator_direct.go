@@ -0,0 +1,25 @@
+package traproxy
+
+import (
+	"context"
+)
+
+// DirectTranslator is translator for connection bypassing proxy.
+// Proxy socket is connected to destination directly
+type DirectTranslator struct {
+	TranslatorBase
+}
+
+// Start starts bridging client and destination
+func (t *DirectTranslator) Start(ctx context.Context) (Result, error) {
+	defer t.start(ctx, nil)()
+	client, proxy, err := t.CheckSockets()
+	if err != nil {
+		return t.result(err)
+	}
+	if err := t.WriteBuffered(nil); err != nil {
+		return t.result(err)
+	}
+	t.pipeBoth(client, proxy, nil, nil)
+	return t.result(nil)
+}
@@ -0,0 +1,77 @@
+package traproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestDirectTranslatorStart(t *testing.T) {
+	a, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans := &DirectTranslator{TranslatorBase{Client: a.B, Proxy: b.B, Dst: "example.com:80"}}
+	go trans.Start(context.Background())
+
+	client := a.A.(*net.TCPConn)
+	dst := b.A.(*net.TCPConn)
+	buf := make([]byte, 1024)
+
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	s, err := dst.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:s]) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("request is modified: %s", string(buf[:s]))
+	}
+
+	dst.Write([]byte("response"))
+	s, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:s]) != "response" {
+		t.Errorf("response is modified: %s", string(buf[:s]))
+	}
+}
+
+func TestDirectTranslatorResult(t *testing.T) {
+	a, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans := &DirectTranslator{TranslatorBase{Client: a.B, Proxy: b.B, Dst: "example.com:80", Buffered: []byte("GET")}}
+	results := make(chan Result)
+	go func() {
+		r, _ := trans.Start(context.Background())
+		results <- r
+	}()
+
+	client := a.A.(*net.TCPConn)
+	dst := b.A.(*net.TCPConn)
+	client.Write([]byte(" / HTTP/1.1\r\n\r\n"))
+	readUntil(t, dst, "GET / HTTP/1.1\r\n\r\n")
+	dst.Write([]byte("response"))
+	readUntil(t, client, "response")
+
+	client.CloseWrite()
+	if _, err := dst.Read(make([]byte, 1)); err == nil {
+		t.Error("EOF is not sent to destination")
+	}
+	dst.Close()
+	r := <-results
+	expected := Result{Sent: 18, Received: 8, CloseReason: CloseClient}
+	if r != expected {
+		t.Errorf("result=%+v", r)
+	}
+}
@@ -0,0 +1,243 @@
+package traproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// H2CPreface is connection preface sent by HTTP/2 client with prior knowledge
+var H2CPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// H2CMode represents how HTTP/2 cleartext connection is sent to proxy
+type H2CMode int
+
+const (
+	// H2CTunnel tunnels connection through CONNECT to the original destination
+	H2CTunnel H2CMode = iota
+	// H2CTranslate translates HTTP/2 requests into HTTP/1.1 requests to proxy
+	H2CTranslate
+)
+
+// ParseH2CMode returns H2CMode from string
+func ParseH2CMode(s string) (H2CMode, error) {
+	switch s {
+	case "tunnel":
+		return H2CTunnel, nil
+	case "translate":
+		return H2CTranslate, nil
+	}
+	return H2CTunnel, fmt.Errorf("unknown h2c mode: %s", s)
+}
+
+// readPreface reads Client until Buffered is found to be HTTP/2 preface or not
+func (t *TranslatorBase) readPreface() (bool, error) {
+	buf := make([]byte, len(H2CPreface))
+	for len(t.Buffered) < len(H2CPreface) && bytes.HasPrefix(H2CPreface, t.Buffered) {
+		n, err := t.Client.Read(buf)
+		t.Buffered = append(t.Buffered, buf[:n]...)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return bytes.HasPrefix(t.Buffered, H2CPreface), nil
+}
+
+// hopHeaders are not forwarded to HTTP/2 client
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// H2CTranslator is translator for HTTP/2 cleartext connection.
+// Each stream is sent to proxy as HTTP/1.1 request
+type H2CTranslator struct {
+	TranslatorBase
+	// Dial connects to proxy for concurrent streams. Default is net.Dialer
+	Dial func(addr string) (net.Conn, error)
+
+	transport *nethttp.Transport
+	mu        sync.Mutex
+	// idle is Proxy not used by transport yet
+	idle net.Conn
+}
+
+// dial returns Proxy at first, and new connection to proxy for concurrent streams
+func (t *H2CTranslator) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	c := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	if c == nil {
+		var err error
+		if t.Dial != nil {
+			c, err = t.Dial(addr)
+		} else {
+			d := net.Dialer{}
+			c, err = d.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, received := t.counters()
+	return &countConn{Conn: c, n: received}, nil
+}
+
+func (t *H2CTranslator) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	t.addRequests(1)
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = r.Host
+	if req.URL.Host == "" {
+		req.URL.Host = t.DstHostPort()
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		t.Logf("failed to translate h2c request: %s", err)
+		w.WriteHeader(nethttp.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	t.Logf("%s %s %d", req.Method, req.URL, resp.StatusCode)
+	t.setUpstreamStatus(resp.StatusCode)
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	rc := nethttp.NewResponseController(w)
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+	for k, v := range resp.Trailer {
+		w.Header()[nethttp.TrailerPrefix+k] = v
+	}
+}
+
+// Start starts translation for h2c
+func (t *H2CTranslator) Start(ctx context.Context) (Result, error) {
+	defer t.start(ctx, nil)()
+	t.idle = t.Proxy
+	t.transport = &nethttp.Transport{
+		Proxy:       nethttp.ProxyURL(&url.URL{Scheme: "http", Host: t.Proxy.RemoteAddr().String()}),
+		DialContext: t.dial,
+	}
+	defer t.transport.CloseIdleConnections()
+
+	sent, _ := t.counters()
+	ln := &connListener{
+		conn:   &bufferedConn{countConn: countConn{Conn: t.Client, n: sent}, buf: t.Buffered},
+		closed: make(chan struct{}),
+	}
+	t.Buffered = nil
+	protocols := nethttp.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &nethttp.Server{
+		Handler:   t,
+		Protocols: &protocols,
+		ConnState: func(c net.Conn, s nethttp.ConnState) {
+			if s == nethttp.StateClosed {
+				ln.Close()
+			}
+		},
+	}
+	if err := srv.Serve(ln); err != net.ErrClosed {
+		return t.result(err)
+	}
+	t.closeWith(CloseClient)
+	return t.result(nil)
+}
+
+// countConn is net.Conn adding bytes read to n if not nil
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.n != nil {
+		atomic.AddInt64(c.n, int64(n))
+	}
+	return n, err
+}
+
+// bufferedConn is net.Conn returning buf before reading Conn
+type bufferedConn struct {
+	countConn
+	buf []byte
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		if c.n != nil {
+			atomic.AddInt64(c.n, int64(n))
+		}
+		return n, nil
+	}
+	return c.countConn.Read(b)
+}
+
+// connListener is net.Listener accepting only conn
+type connListener struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	c := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
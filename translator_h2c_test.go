@@ -0,0 +1,209 @@
+package traproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	nethttp "net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// h2cSettings is empty SETTINGS frame following preface
+var h2cSettings = []byte{0, 0, 0, 4, 0, 0, 0, 0, 0}
+
+func TestParseH2CMode(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected H2CMode
+		hasError bool
+	}{
+		{"tunnel", H2CTunnel, false},
+		{"translate", H2CTranslate, false},
+		{"h2", H2CTunnel, true},
+	}
+	for _, v := range tests {
+		got, err := ParseH2CMode(v.in)
+		if got != v.expected || (err != nil) != v.hasError {
+			t.Errorf("%s: got=%v, err=%v", v.in, got, err)
+		}
+	}
+}
+
+func TestHTTPTranslatorH2CTunnel(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer proxy.Close()
+	trans.Dst = "192.0.2.1:80"
+	go trans.Start(context.Background())
+
+	// preface is split to check that detection waits for whole preface
+	client.Write(H2CPreface[:3])
+	client.Write(append(H2CPreface[3:], h2cSettings...))
+
+	connect := "CONNECT 192.0.2.1:80 HTTP/1.1\r\n\r\n"
+	if got := readUntil(t, proxy, connect); got != connect {
+		t.Errorf("got=%q", got)
+	}
+	proxy.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	expected := string(H2CPreface) + string(h2cSettings)
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q", got)
+	}
+}
+
+func TestHTTPTranslatorNotH2C(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer proxy.Close()
+	go trans.Start(context.Background())
+
+	client.Write([]byte("PRI / HTTP/1.1\r\n\r\n"))
+	expected := "PRI http://example.com/ HTTP/1.1\r\n\r\n"
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q", got)
+	}
+}
+
+func TestHTTPTranslatorH2CTranslate(t *testing.T) {
+	// proxy receives http/1.1 requests in absolute-form
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(r.Proto + " " + r.RequestURI + " " + string(body)))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+
+	s, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.A.Close()
+	proxy, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	trans := &HTTPTranslator{
+		TranslatorBase: TranslatorBase{Client: s.A, Proxy: proxy, Dst: "192.0.2.1:80"},
+		H2C:            H2CTranslate,
+	}
+	go trans.Start(context.Background())
+
+	protocols := nethttp.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	c := &nethttp.Client{Transport: &nethttp.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.B, nil
+		},
+	}}
+	defer c.CloseIdleConnections()
+	resp, err := c.Post("http://example.com/svc/Method", "application/grpc", nethttp.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("response is not http/2: %s", resp.Proto)
+	}
+	if string(body) != "HTTP/1.1 http://example.com/svc/Method " {
+		t.Errorf("got=%q", body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("trailer is not forwarded: %v", resp.Trailer)
+	}
+}
+
+func TestH2CTranslatorDial(t *testing.T) {
+	// handler returns when two requests are in flight on separate connections
+	var inflight sync.WaitGroup
+	inflight.Add(2)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go nethttp.Serve(ln, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.URL.Path == "/wait" {
+			inflight.Done()
+			inflight.Wait()
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	s, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.A.Close()
+	proxy, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	var dials int32
+	trans := &H2CTranslator{
+		TranslatorBase: TranslatorBase{Client: s.A, Proxy: proxy, Dst: "192.0.2.1:80"},
+		Dial: func(addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial("tcp", ln.Addr().String())
+		},
+	}
+	go trans.Start(context.Background())
+
+	protocols := nethttp.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	c := &nethttp.Client{
+		Timeout: 5 * time.Second,
+		Transport: &nethttp.Transport{
+			Protocols: &protocols,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return s.B, nil
+			},
+		},
+	}
+	defer c.CloseIdleConnections()
+	// client connection is established before concurrent requests
+	resp, err := c.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := c.Get("http://example.com/wait")
+			if err == nil {
+				resp.Body.Close()
+			}
+			errc <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("dials=%d", n)
+	}
+}
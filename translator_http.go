@@ -2,6 +2,9 @@ package traproxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
 	"sync"
 
 	"github.com/nyushi/traproxy/http"
@@ -11,76 +14,461 @@ import (
 type HTTPTranslator struct {
 	TranslatorBase
 
-	buf               []byte
+	// OnResponse is called when response for request is completed.
+	// Default logs request line and status
+	OnResponse func(req *http.RequestHeader, resp *http.ResponseHeader)
+	// HeaderRules are applied to each request in order
+	HeaderRules []HeaderRule
+	// MaxHeaderSize is limit of request header size. Default is http.DefaultMaxHeaderSize
+	MaxHeaderSize int
+	// H2C is how to send HTTP/2 connection with prior knowledge
+	H2C H2CMode
+	// Router decides upstream connection of each request.
+	// All requests are sent to Proxy if nil
+	Router func(req *http.RequestHeader) Route
+	// Dial connects to upstream for Router and h2c streams. Default is net.Dial
+	Dial func(addr string) (net.Conn, error)
+	// Pool receives Proxy from it after client is closed if the connection is kept alive.
+	// Proxy is discarded if not reusable. Pool is not used with Router
+	Pool *Pool
+
+	// buf keeps incomplete request header
+	buf []byte
+	// out is reused for bytes written to proxy
+	out               []byte
 	processingRequest *http.RequestHeader
+	responses         http.ResponseTracker
+	rejected          bool
+
+	mu      sync.Mutex
+	upgrade upgradeState
+	// upgradeRequest is the request which upgrade waits for response
+	upgradeRequest *http.RequestHeader
+	// held keeps client bytes after upgrade request until its response
+	held []byte
+	// resuming is set when held bytes are sent with resumeState
+	resuming    bool
+	resumeState upgradeState
+	// sendMu keeps order of bytes for proxy while held bytes are sent
+	sendMu sync.Mutex
+	// draining is set by Drain
+	draining bool
+	// h2c is true after connection is handed over for h2c
+	h2c bool
+	// rejectErr is set when request is rejected
+	rejectErr error
+	// proxyClose is true if the last response closes connection
+	proxyClose bool
+	// proxyDone is true if reading Proxy is finished
+	proxyDone bool
+	reusable  bool
+
+	// fields for Router.
+	// lastRequest is the request which bytes for proxy belong to
+	lastRequest *http.RequestHeader
+	spans       []requestSpan
+	current     *upstream
+	idle        net.Conn
+	wg          sync.WaitGroup
+	routeMu     sync.Mutex
+	upstreams   map[Route]*upstream
+	active      map[*upstream]bool
+	// turns are upstreams of requests waiting for response in order
+	turns    []*upstream
+	turn     *sync.Cond
+	finished bool
+}
+
+var httpScheme = []byte("http://")
+
+var errHeldTooLarge = errors.New("too many bytes before response to upgrade request")
+
+type upgradeState int
+
+const (
+	upgradeNone upgradeState = iota
+	// upgradePending is waiting for response of upgrade request.
+	// client bytes are held until the response
+	upgradePending
+	// upgradeDone is switched protocols. all bytes are passed through
+	upgradeDone
+)
+
+func (t *HTTPTranslator) handleResponse(req *http.RequestHeader, resp *http.ResponseHeader) {
+	t.mu.Lock()
+	if t.upgrade == upgradePending && req == t.upgradeRequest && !t.resuming {
+		// held bytes are sent by resumeRequests after tracker returns
+		if resp.SwitchesProtocol(req) {
+			t.resuming = true
+			t.resumeState = upgradeDone
+		} else if !resp.IsInformational() {
+			t.resuming = true
+			t.resumeState = upgradeNone
+		}
+	}
+	if !resp.IsInformational() {
+		t.proxyClose = resp.Close
+	}
+	if !resp.IsInformational() || resp.SwitchesProtocol(req) {
+		t.setUpstreamStatus(resp.StatusCode)
+	}
+	if req != nil && req == t.processingRequest && req.ExpectContinue() &&
+		req.BodyRead == 0 && !resp.IsInformational() && resp.Close {
+		// server rejected before 100 Continue and closes connection.
+		// client will not send the body
+		req.SkipBody()
+		t.processingRequest = nil
+	}
+	t.mu.Unlock()
+
+	if t.OnResponse != nil {
+		t.OnResponse(req, resp)
+	} else {
+		t.logResponse(req, resp)
+	}
+}
+
+func (t *HTTPTranslator) logResponse(req *http.RequestHeader, resp *http.ResponseHeader) {
+	if req == nil {
+		t.Logf("response without request: %d", resp.StatusCode)
+		return
+	}
+	t.Logf("%s %d", req.ReqLine(), resp.StatusCode)
+}
+
+func (t *HTTPTranslator) filterResponse(in []byte) []byte {
+	if err := t.responses.Feed(in); err != nil {
+		t.Logf("failed to track response: %s", err)
+	}
+	t.resumeRequests()
+	t.closeIfDrained()
+	return in
 }
 
 func (t *HTTPTranslator) filterRequest(in []byte) []byte {
-	t.buf = append(t.buf, in...)
-	out := []byte{}
-	for {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	return t.sendRequests(in)
+}
+
+// sendRequests reads requests in bytes and tracks them. Caller must hold t.sendMu
+func (t *HTTPTranslator) sendRequests(in []byte) []byte {
+	t.mu.Lock()
+	out, reqs := t.readRequests(in)
+	rejectErr := t.rejectErr
+	t.mu.Unlock()
+
+	// requests are tracked out of t.mu because tracker calls handleResponse with its lock
+	for _, req := range reqs {
+		t.responses.AddRequest(req)
+	}
+	if rejectErr != nil && !t.rejected {
+		t.rejected = true
+		t.rejectRequest(rejectErr)
+	}
+	return out
+}
+
+// resumeRequests sends held bytes after response of upgrade request.
+// They are passed through if upgraded, otherwise read as requests
+func (t *HTTPTranslator) resumeRequests() {
+	t.mu.Lock()
+	resuming := t.resuming
+	t.mu.Unlock()
+	if !resuming {
+		return
+	}
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	t.mu.Lock()
+	t.resuming = false
+	t.upgrade = t.resumeState
+	t.upgradeRequest = nil
+	held := t.held
+	t.held = nil
+	t.mu.Unlock()
+	if len(held) == 0 {
+		return
+	}
+	if t.Router != nil {
+		t.forward(held)
+		return
+	}
+	if _, err := t.Proxy.Write(t.sendRequests(held)); err != nil {
+		t.Logf("failed to write held bytes: %s", err)
+	}
+}
+
+// hold keeps client bytes until response of upgrade request
+func (t *HTTPTranslator) hold(b []byte) {
+	if len(t.held)+len(b) > t.maxHeaderSize() {
+		t.rejectErr = errHeldTooLarge
+		return
+	}
+	t.held = append(t.held, b...)
+}
+
+func (t *HTTPTranslator) clientIP() string {
+	if t.Client == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(t.Client.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// readRequests rewrites requests in bytes and returns bytes for proxy and parsed requests.
+// Body bytes are returned without copying if in has only body
+func (t *HTTPTranslator) readRequests(in []byte) ([]byte, []*http.RequestHeader) {
+	if t.rejectErr != nil {
+		return in, nil
+	}
+	if t.upgrade == upgradePending {
+		t.hold(in)
+		return nil, nil
+	}
+	if t.upgrade == upgradeDone {
+		t.mark(len(in))
+		return in, nil
+	}
+	req := t.processingRequest
+	if len(t.buf) == 0 && req != nil && len(in) < req.BodySize-req.BodyRead {
+		req.BodyRead += len(in)
+		t.mark(len(in))
+		return in, nil
+	}
+
+	var reqs []*http.RequestHeader
+	data := in
+	if len(t.buf) > 0 {
+		data = append(t.buf, in...)
+	}
+	t.buf = nil
+	out := t.out[:0]
+	for len(data) > 0 {
 		if t.processingRequest == nil {
-			rest, req, err := http.ReadRequestHeader(t.buf)
-			t.buf = rest
-			if err != nil {
+			size := http.HeaderEnd(data)
+			if size == -1 {
+				if len(data) > t.maxHeaderSize() {
+					t.rejectErr = http.ErrHeaderTooLarge
+					break
+				}
+				// header bytes are kept until the end of header
+				t.buf = append([]byte(nil), data...)
 				break
 			}
-			if req == nil {
+			if size > t.maxHeaderSize() {
+				t.rejectErr = http.ErrHeaderTooLarge
 				break
 			}
-			t.processingRequest = req
-			hasHostHeader := false
-			for _, h := range req.Headers {
-				if bytes.Equal(bytes.ToLower(h[0]), []byte("host")) {
-					hasHostHeader = true
-					req.SetRequestURI("http://" + string(h[1]) + string(req.ReqLineTokens[1]))
-					break
-				}
-			}
-			if !hasHostHeader {
-				req.SetRequestURI("http://" + t.Dst + string(req.ReqLineTokens[1]))
+			// request is used after in is reused, so header is copied
+			req, err := http.NewRequestHeader(append([]byte(nil), data[:size]...))
+			if err != nil {
+				t.rejectErr = err
+				break
 			}
-			out = append(out, req.Bytes()...)
+			data = data[size:]
+			t.rewriteRequest(req)
+			reqs = append(reqs, req)
+			t.addRequests(1)
+			t.mark(len(out))
+			t.lastRequest = req
+			out = req.AppendBytes(out)
+			t.processingRequest = req
 		}
 
-		if t.processingRequest != nil {
-			rest, body := http.ReadRequestBody(t.buf, t.processingRequest)
-			t.buf = rest
-			if t.processingRequest.IsCompleted() {
-				t.processingRequest = nil
+		req := t.processingRequest
+		n, err := req.ReadBody(data)
+		out = append(out, data[:n]...)
+		data = data[n:]
+		if err != nil {
+			t.rejectErr = err
+			break
+		}
+		if req.IsCompleted() {
+			t.processingRequest = nil
+			if req.IsUpgrade() || req.IsConnect() {
+				t.upgrade = upgradePending
+				t.upgradeRequest = req
+				t.hold(data)
+				break
 			}
-			out = append(out, body...)
 		}
-		if len(t.buf) == 0 {
-			break
+	}
+	t.mark(len(out))
+	t.out = out
+	return out, reqs
+}
+
+// rewriteRequest rewrites request-target to absolute-form for proxy, removes Proxy-Connection and applies HeaderRules
+func (t *HTTPTranslator) rewriteRequest(req *http.RequestHeader) {
+	path := req.ReqLineTokens[1]
+	switch req.TargetForm() {
+	case http.AbsoluteForm, http.AuthorityForm:
+		// client already knows about proxy
+		path = nil
+	case http.AsteriskForm:
+		// proxy forwards "OPTIONS http://host" as "OPTIONS *"
+		path = []byte{}
+	default:
+		if !bytes.HasPrefix(path, []byte("/")) {
+			path = append([]byte("/"), path...)
 		}
 	}
-	return out
+	if path != nil {
+		host, ok := req.Header("Host")
+		if !ok {
+			host = []byte(t.DstHostPort())
+		}
+		uri := make([]byte, 0, len(httpScheme)+len(host)+len(path))
+		uri = append(uri, httpScheme...)
+		uri = append(uri, host...)
+		req.ReqLineTokens[1] = append(uri, path...)
+	}
+
+	// Proxy-Connection is hop-by-hop header between client and traproxy
+	req.DelHeader("Proxy-Connection")
+	for _, r := range t.HeaderRules {
+		r.Apply(req, t.clientIP())
+	}
+}
+
+func (t *HTTPTranslator) maxHeaderSize() int {
+	if t.MaxHeaderSize > 0 {
+		return t.MaxHeaderSize
+	}
+	return http.DefaultMaxHeaderSize
+}
+
+// rejectRequest responds error status for err if no response is in progress and closes connection
+func (t *HTTPTranslator) rejectRequest(err error) {
+	t.Logf("rejected request: %s", err)
+	t.closeWith(CloseRejected)
+	resp := http.BadRequestResponse
+	if err == http.ErrHeaderTooLarge {
+		resp = http.HeaderTooLargeResponse
+	} else if _, ok := err.(*upstreamError); ok {
+		resp = http.BadGatewayResponse
+	}
+	if t.pending() == 0 {
+		t.Client.Write(resp)
+	}
+	if t.Router != nil {
+		t.abort()
+		return
+	}
+	t.Client.Close()
+	t.Proxy.Close()
+}
+
+// Drain closes connection when no request is in progress.
+// Server calls it at Shutdown
+func (t *HTTPTranslator) Drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	t.closeIfDrained()
+}
+
+// inProgress reports whether a request is in progress
+func (t *HTTPTranslator) inProgress() bool {
+	// tracker lock is not taken under t.mu
+	if t.pending() > 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.h2c || t.upgrade != upgradeNone || t.processingRequest != nil ||
+		len(t.buf) > 0 || t.rejectErr != nil
+}
+
+// closeIfDrained stops reading client if draining and idle.
+// Proxy sees end of requests and responses in progress are sent before close
+func (t *HTTPTranslator) closeIfDrained() {
+	t.mu.Lock()
+	draining := t.draining
+	t.mu.Unlock()
+	if !draining || t.inProgress() {
+		return
+	}
+	t.closeWith(CloseDrained)
+	if c, ok := t.Client.(tcpconn); ok {
+		c.CloseRead()
+		return
+	}
+	t.Client.Close()
+}
+
+// startH2C hands HTTP/2 connection over to translator for H2C
+func (t *HTTPTranslator) startH2C(ctx context.Context) (Result, error) {
+	t.mu.Lock()
+	t.h2c = true
+	t.mu.Unlock()
+	t.Logf("h2c connection")
+	if t.H2C == H2CTranslate {
+		return (&H2CTranslator{TranslatorBase: t.TranslatorBase, Dial: t.Dial}).Start(ctx)
+	}
+	return (&HTTPSTranslator{TranslatorBase: t.TranslatorBase}).Start(ctx)
 }
 
 // Start starts translation for http
-func (t *HTTPTranslator) Start() error {
-	t.buf = []byte{}
+func (t *HTTPTranslator) Start(ctx context.Context) (Result, error) {
+	t.responses.OnResponse = t.handleResponse
+	if t.Pool != nil {
+		defer t.releaseProxy()
+	}
+	abort := t.closeSockets
+	if t.Router != nil {
+		t.initRouted()
+		abort = t.abort
+	}
+	defer t.start(ctx, abort)()
 
 	client, proxy, err := t.CheckSockets()
 	if err != nil {
-		return err
+		return t.result(err)
+	}
+	h2c, err := t.readPreface()
+	if err != nil {
+		return t.result(err)
+	}
+	if h2c {
+		return t.startH2C(ctx)
+	}
+	if t.Router != nil {
+		t.startRouted()
+		return t.result(nil)
+	}
+	if err := t.WriteBuffered(t.filterRequest); err != nil {
+		return t.result(err)
+	}
+	if t.Pool != nil {
+		t.startPooled(client, proxy)
+		return t.result(nil)
 	}
+	sent, received := t.counters()
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer t.HandlePanic()
 
-		Pipe(client, proxy, nil)
+		f := t.filterResponse
+		pipe(client, proxy, &f, received)
+		t.responses.Close()
+		t.closeWith(CloseUpstream)
 	}()
 	go func() {
 		defer wg.Done()
 		defer t.HandlePanic()
 
 		f := t.filterRequest
-		Pipe(proxy, client, &f)
+		pipe(proxy, client, &f, sent)
+		t.closeWith(CloseClient)
 	}()
 	wg.Wait()
-	return nil
+	return t.result(nil)
 }
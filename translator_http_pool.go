@@ -0,0 +1,113 @@
+package traproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// keepAlive reports whether Proxy can be reused after client is closed
+func (t *HTTPTranslator) keepAlive() bool {
+	// tracker lock is not taken under t.mu
+	if t.responses.Pending() > 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.proxyDone && !t.proxyClose && t.upgrade == upgradeNone &&
+		t.processingRequest == nil && len(t.buf) == 0 && t.rejectErr == nil
+}
+
+// releaseProxy returns Proxy to Pool if reusable
+func (t *HTTPTranslator) releaseProxy() {
+	t.mu.Lock()
+	reusable := t.reusable && !t.proxyDone
+	t.mu.Unlock()
+	if reusable {
+		t.Pool.Put(t.Proxy)
+		return
+	}
+	t.Pool.Discard(t.Proxy)
+}
+
+// readPooledProxy sends responses to client until Proxy is closed or released
+func (t *HTTPTranslator) readPooledProxy(client, proxy *net.TCPConn) {
+	defer client.CloseWrite()
+	buf := pipeBufPool.Get().([]byte)
+	defer pipeBufPool.Put(buf)
+	for {
+		n, err := proxy.Read(buf)
+		t.addReceived(n)
+		if n > 0 {
+			if _, err := client.Write(t.filterResponse(buf[:n])); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// deadline is set by releasing
+				return
+			}
+			if isRecoverable(err) {
+				continue
+			}
+			t.responses.Close()
+			break
+		}
+	}
+	t.closeWith(CloseUpstream)
+	t.mu.Lock()
+	t.proxyDone = true
+	t.mu.Unlock()
+}
+
+// writePooledProxy sends requests to Proxy until client is closed.
+// Proxy is released if kept alive, otherwise it is closed for writing
+func (t *HTTPTranslator) writePooledProxy(client, proxy *net.TCPConn) {
+	buf := pipeBufPool.Get().([]byte)
+	defer pipeBufPool.Put(buf)
+	for {
+		n, err := client.Read(buf)
+		t.addSent(n)
+		if n > 0 {
+			if _, err := proxy.Write(t.filterRequest(buf[:n])); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if isRecoverable(err) {
+				continue
+			}
+			break
+		}
+	}
+	t.closeWith(CloseClient)
+
+	if !t.keepAlive() {
+		proxy.CloseWrite()
+		return
+	}
+	t.mu.Lock()
+	t.reusable = true
+	t.mu.Unlock()
+	// stops readPooledProxy without closing
+	proxy.SetReadDeadline(time.Now())
+}
+
+// startPooled starts translation keeping Proxy open for Pool
+func (t *HTTPTranslator) startPooled(client, proxy *net.TCPConn) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer t.HandlePanic()
+		t.readPooledProxy(client, proxy)
+	}()
+	go func() {
+		defer wg.Done()
+		defer t.HandlePanic()
+		t.writePooledProxy(client, proxy)
+	}()
+	wg.Wait()
+	proxy.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,90 @@
+package traproxy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startPoolTranslator translates a client connection sending req with proxy from p
+func startPoolTranslator(t *testing.T, p *Pool, proxyAddr string, req string) string {
+	s, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.A.Close()
+	defer s.B.Close()
+	proxy, err := p.Get(context.Background(), proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans := &HTTPTranslator{
+		TranslatorBase: TranslatorBase{Client: s.B, Proxy: proxy, Dst: "192.0.2.1:80"},
+		Pool:           p,
+	}
+	done := make(chan struct{})
+	go func() {
+		trans.Start(context.Background())
+		close(done)
+	}()
+
+	s.A.Write([]byte(req))
+	got := readResponseBodies(t, s.A, 1)
+	s.A.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("translator is not finished")
+	}
+	return got[0]
+}
+
+func TestHTTPTranslatorPool(t *testing.T) {
+	proxyAddr, conns := startRouteProxy(t, false)
+	p := &Pool{}
+	defer p.CloseIdle()
+
+	for i := 0; i < 3; i++ {
+		got := startPoolTranslator(t, p, proxyAddr, fmt.Sprintf("GET /%d HTTP/1.1\r\nHost: example.com\r\n\r\n", i))
+		if got != fmt.Sprintf("http://example.com/%d", i) {
+			t.Errorf("got=%s", got)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("connections=%d", n)
+	}
+	if s := p.Stats(); s.Hits != 2 || s.Misses != 1 || s.Idle != 1 {
+		t.Errorf("stats=%+v", s)
+	}
+}
+
+func TestHTTPTranslatorPoolConnectionClose(t *testing.T) {
+	proxyAddr, conns := startRouteProxy(t, true)
+	p := &Pool{}
+	defer p.CloseIdle()
+
+	for i := 0; i < 2; i++ {
+		startPoolTranslator(t, p, proxyAddr, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("connections=%d", n)
+	}
+	if s := p.Stats(); s.Hits != 0 || s.Idle != 0 || s.InUse != 0 {
+		t.Errorf("stats=%+v", s)
+	}
+}
+
+func TestHTTPTranslatorPoolIncompleteRequest(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	p := &Pool{}
+	defer p.CloseIdle()
+
+	// body of the second request is not sent
+	startPoolTranslator(t, p, proxyAddr, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+		"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\n")
+	if s := p.Stats(); s.Idle != 0 || s.InUse != 0 {
+		t.Errorf("stats=%+v", s)
+	}
+}
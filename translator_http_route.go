@@ -0,0 +1,375 @@
+package traproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nyushi/traproxy/http"
+)
+
+// Route is upstream connection of a request decided by Router.
+// Requests with the same Route share a connection
+type Route struct {
+	// Addr is address of upstream proxy. Empty is the address of Proxy
+	Addr string
+	// Key separates connections to the same Addr
+	Key string
+	// Close closes the connection after the response
+	Close bool
+}
+
+// RouteByHost uses a connection for each Host
+func RouteByHost(req *http.RequestHeader) Route {
+	host, ok := req.Authority()
+	if !ok {
+		host, _ = req.Header("Host")
+	}
+	return Route{Key: strings.ToLower(string(host))}
+}
+
+// RouteEachRequest uses a new connection for each request
+func RouteEachRequest(req *http.RequestHeader) Route {
+	return Route{Close: true}
+}
+
+// ParseRouter returns Router from name. Router for "connection" is nil
+func ParseRouter(s string) (func(*http.RequestHeader) Route, error) {
+	switch s {
+	case "connection":
+		return nil, nil
+	case "host":
+		return RouteByHost, nil
+	case "request":
+		return RouteEachRequest, nil
+	}
+	return nil, fmt.Errorf("unknown route: %s", s)
+}
+
+// upstream is connection to proxy with responses of requests sent on it
+type upstream struct {
+	route     Route
+	conn      net.Conn
+	responses http.ResponseTracker
+	// closing is set to 1 if upstream closes after response
+	closing int32
+}
+
+// requestSpan is bytes for proxy which belong to req, ending at end
+type requestSpan struct {
+	req *http.RequestHeader
+	end int
+}
+
+// mark records that bytes for proxy until end belong to lastRequest
+func (t *HTTPTranslator) mark(end int) {
+	if t.Router == nil || t.lastRequest == nil {
+		return
+	}
+	start := 0
+	if n := len(t.spans); n > 0 {
+		if t.spans[n-1].req == t.lastRequest {
+			t.spans[n-1].end = end
+			return
+		}
+		start = t.spans[n-1].end
+	}
+	if end == start {
+		return
+	}
+	t.spans = append(t.spans, requestSpan{req: t.lastRequest, end: end})
+}
+
+func (t *HTTPTranslator) dial(addr string) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial(addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// upstreamFor returns connection for req. Caller must hold t.routeMu
+func (t *HTTPTranslator) upstreamFor(req *http.RequestHeader) (*upstream, error) {
+	route := t.Router(req)
+	if u, ok := t.upstreams[route]; ok {
+		return u, nil
+	}
+
+	u := &upstream{route: route}
+	u.responses.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {
+		if resp.Close && !resp.IsInformational() {
+			atomic.StoreInt32(&u.closing, 1)
+		}
+		t.handleResponse(req, resp)
+	}
+	addr := route.Addr
+	if addr == "" {
+		addr = t.Proxy.RemoteAddr().String()
+	}
+	if t.idle != nil && addr == t.Proxy.RemoteAddr().String() {
+		// Proxy is dialed before the first request
+		u.conn = t.idle
+		t.idle = nil
+	} else {
+		conn, err := t.dial(addr)
+		if err != nil {
+			return nil, &upstreamError{err}
+		}
+		u.conn = conn
+	}
+	if !route.Close {
+		t.upstreams[route] = u
+	}
+	t.active[u] = true
+	t.wg.Add(1)
+	go t.readUpstream(u)
+	return u, nil
+}
+
+// upstreamError is error at connecting upstream
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("failed to connect upstream: %s", e.err)
+}
+
+// forward reads requests in b and writes them to upstream connections. Caller must hold t.sendMu
+func (t *HTTPTranslator) forward(b []byte) {
+	t.mu.Lock()
+	out, reqs := t.readRequests(b)
+	spans := t.spans
+	t.spans = t.spans[:0]
+	rejectErr := t.rejectErr
+	t.mu.Unlock()
+
+	t.routeMu.Lock()
+	routed := map[*http.RequestHeader]*upstream{}
+	for _, req := range reqs {
+		u, err := t.upstreamFor(req)
+		if err != nil {
+			rejectErr = err
+			break
+		}
+		routed[req] = u
+		u.responses.AddRequest(req)
+		t.turns = append(t.turns, u)
+	}
+	t.routeMu.Unlock()
+
+	start := 0
+	for _, s := range spans {
+		if u, ok := routed[s.req]; ok {
+			t.current = u
+		} else if len(routed) < len(reqs) && s.req == reqs[len(routed)] {
+			// request is not routed
+			break
+		}
+		if t.current != nil {
+			if _, err := t.current.conn.Write(out[start:s.end]); err != nil {
+				t.Logf("failed to write to upstream: %s", err)
+			}
+		}
+		start = s.end
+	}
+
+	if rejectErr != nil && !t.rejected {
+		t.rejected = true
+		t.rejectRequest(rejectErr)
+	}
+}
+
+// waitTurn waits until response from u is sent to client in order of requests.
+// It returns false if translation is finished
+func (t *HTTPTranslator) waitTurn(u *upstream) bool {
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	for !t.finished && !u.responses.Upgraded() && (len(t.turns) == 0 || t.turns[0] != u) {
+		t.turn.Wait()
+	}
+	return !t.finished
+}
+
+func (t *HTTPTranslator) nextTurn() {
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	t.turns = t.turns[1:]
+	t.turn.Broadcast()
+}
+
+// readUpstream sends responses from u to client in order of requests
+func (t *HTTPTranslator) readUpstream(u *upstream) {
+	defer t.wg.Done()
+	defer t.HandlePanic()
+	defer func() {
+		t.routeMu.Lock()
+		delete(t.active, u)
+		t.routeMu.Unlock()
+	}()
+
+	buf := pipeBufPool.Get().([]byte)
+	defer pipeBufPool.Put(buf)
+	for {
+		n, err := u.conn.Read(buf)
+		t.addReceived(n)
+		b := buf[:n]
+		if n > 0 && u.responses.Pending() == 0 && !u.responses.Upgraded() {
+			// requests are tracked before written, so bytes are not response for them
+			t.Logf("drop bytes from idle upstream: %q", b)
+			b = nil
+		}
+		for len(b) > 0 {
+			if !t.waitTurn(u) {
+				return
+			}
+			m, done, err := u.responses.FeedResponse(b)
+			if err != nil {
+				t.Logf("failed to track response: %s", err)
+				t.abort()
+				return
+			}
+			t.resumeRequests()
+			if done && atomic.LoadInt32(&u.closing) == 1 {
+				// next request reconnects before client receives the response
+				t.forget(u)
+			}
+			if _, err := t.Client.Write(b[:m]); err != nil {
+				t.abort()
+				return
+			}
+			b = b[m:]
+			if done {
+				t.nextTurn()
+				t.closeIfDrained()
+				if u.route.Close && u.responses.Pending() == 0 {
+					u.conn.Close()
+					return
+				}
+			}
+		}
+		if err != nil {
+			t.closeUpstream(u)
+			return
+		}
+	}
+}
+
+// closeUpstream handles end of u. Response delimited by close is completed
+func (t *HTTPTranslator) closeUpstream(u *upstream) {
+	if u.responses.Upgraded() {
+		// upgraded connection ends with upstream
+		t.closeWith(CloseUpstream)
+		if c, ok := t.Client.(tcpconn); ok {
+			c.CloseWrite()
+		}
+		return
+	}
+	pending := u.responses.Pending()
+	if pending > 0 && t.waitTurn(u) {
+		u.responses.Close()
+		if u.responses.Pending() < pending {
+			t.nextTurn()
+		}
+	}
+
+	t.forget(u)
+	if u.responses.Pending() > 0 {
+		t.Logf("upstream is closed before response")
+		t.closeWith(CloseError)
+		t.abort()
+	}
+}
+
+// forget removes u from upstreams, so next request reconnects
+func (t *HTTPTranslator) forget(u *upstream) {
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	if t.upstreams[u.route] == u {
+		delete(t.upstreams, u.route)
+	}
+}
+
+// activeConns returns connections of upstreams in use
+func (t *HTTPTranslator) activeConns() []net.Conn {
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	conns := make([]net.Conn, 0, len(t.active))
+	for u := range t.active {
+		conns = append(conns, u.conn)
+	}
+	return conns
+}
+
+// abort closes client and all upstream connections
+func (t *HTTPTranslator) abort() {
+	t.routeMu.Lock()
+	t.finished = true
+	t.turn.Broadcast()
+	t.routeMu.Unlock()
+	t.closeWith(CloseError)
+
+	t.Client.Close()
+	t.Proxy.Close()
+	for _, c := range t.activeConns() {
+		c.Close()
+	}
+}
+
+// pending returns number of requests waiting for response
+func (t *HTTPTranslator) pending() int {
+	if t.Router == nil {
+		return t.responses.Pending()
+	}
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	return len(t.turns)
+}
+
+// initRouted initializes fields for Router
+func (t *HTTPTranslator) initRouted() {
+	t.upstreams = map[Route]*upstream{}
+	t.active = map[*upstream]bool{}
+	t.idle = t.Proxy
+	t.turn = sync.NewCond(&t.routeMu)
+}
+
+// startRouted starts translation sending requests to upstreams decided by Router
+func (t *HTTPTranslator) startRouted() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer t.HandlePanic()
+
+		if len(t.Buffered) > 0 {
+			t.addSent(len(t.Buffered))
+			t.sendMu.Lock()
+			t.forward(t.Buffered)
+			t.sendMu.Unlock()
+			t.Buffered = nil
+		}
+		buf := pipeBufPool.Get().([]byte)
+		defer pipeBufPool.Put(buf)
+		for {
+			n, err := t.Client.Read(buf)
+			if n > 0 {
+				t.addSent(n)
+				t.sendMu.Lock()
+				t.forward(buf[:n])
+				t.sendMu.Unlock()
+			}
+			if err != nil {
+				break
+			}
+		}
+		t.closeWith(CloseClient)
+
+		for _, c := range t.activeConns() {
+			if c, ok := c.(tcpconn); ok {
+				c.CloseWrite()
+			}
+		}
+	}()
+	t.wg.Wait()
+}
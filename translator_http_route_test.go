@@ -0,0 +1,214 @@
+package traproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyushi/traproxy/http"
+)
+
+// startRouteProxy starts proxy responding request-target as body.
+// Responses for host "slow.example" are delayed
+func startRouteProxy(t *testing.T, closeConn bool) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var conns int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					req, err := nethttp.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					if req.Host == "slow.example" {
+						time.Sleep(50 * time.Millisecond)
+					}
+					header := ""
+					if closeConn {
+						header = "Connection: close\r\n"
+					}
+					fmt.Fprintf(c, "HTTP/1.1 200 OK\r\n%sContent-Length: %d\r\n\r\n%s",
+						header, len(req.RequestURI), req.RequestURI)
+					if closeConn {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &conns
+}
+
+func getRouteTranslator(t *testing.T, proxyAddr string, router func(*http.RequestHeader) Route) (net.Conn, *HTTPTranslator) {
+	s, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.A.Close() })
+	proxy, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	trans := &HTTPTranslator{
+		TranslatorBase: TranslatorBase{Client: s.B, Proxy: proxy, Dst: "192.0.2.1:80"},
+		Router:         router,
+	}
+	trans.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {}
+	return s.A, trans
+}
+
+func readResponseBodies(t *testing.T, c net.Conn, n int) []string {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(c)
+	bodies := []string{}
+	for i := 0; i < n; i++ {
+		resp, err := nethttp.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		bodies = append(bodies, string(b))
+	}
+	return bodies
+}
+
+func TestHTTPTranslatorRouteByHost(t *testing.T) {
+	proxyAddr, conns := startRouteProxy(t, false)
+	client, trans := getRouteTranslator(t, proxyAddr, RouteByHost)
+	go trans.Start(context.Background())
+
+	// response for the first request is delayed but delivered first
+	client.Write([]byte("GET /1 HTTP/1.1\r\nHost: slow.example\r\n\r\n" +
+		"GET /2 HTTP/1.1\r\nHost: fast.example\r\n\r\n" +
+		"GET /3 HTTP/1.1\r\nHost: slow.example\r\n\r\n"))
+	got := readResponseBodies(t, client, 3)
+	expected := []string{"http://slow.example/1", "http://fast.example/2", "http://slow.example/3"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got=%v", got)
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("connections=%d", n)
+	}
+}
+
+func TestHTTPTranslatorRouteEachRequest(t *testing.T) {
+	proxyAddr, conns := startRouteProxy(t, false)
+	client, trans := getRouteTranslator(t, proxyAddr, RouteEachRequest)
+	go trans.Start(context.Background())
+
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(client, "POST /%d HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nok", i)
+		got := readResponseBodies(t, client, 1)
+		if got[0] != fmt.Sprintf("http://example.com/%d", i) {
+			t.Errorf("got=%v", got)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 3 {
+		t.Errorf("connections=%d", n)
+	}
+}
+
+func TestHTTPTranslatorRouteReconnect(t *testing.T) {
+	proxyAddr, conns := startRouteProxy(t, true)
+	client, trans := getRouteTranslator(t, proxyAddr, RouteByHost)
+	go trans.Start(context.Background())
+
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(client, "GET /%d HTTP/1.1\r\nHost: example.com\r\n\r\n", i)
+		got := readResponseBodies(t, client, 1)
+		if got[0] != fmt.Sprintf("http://example.com/%d", i) {
+			t.Errorf("got=%v", got)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("connections=%d", n)
+	}
+}
+
+func TestHTTPTranslatorRouteBadGateway(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	client, trans := getRouteTranslator(t, proxyAddr, func(req *http.RequestHeader) Route {
+		return Route{Addr: "127.0.0.1:1"}
+	})
+	go trans.Start(context.Background())
+
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	got, _ := io.ReadAll(client)
+	if !strings.HasPrefix(string(got), "HTTP/1.1 502 ") {
+		t.Errorf("got=%q", got)
+	}
+}
+
+func TestParseRouter(t *testing.T) {
+	for _, s := range []string{"connection", "host", "request"} {
+		r, err := ParseRouter(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if (r == nil) != (s == "connection") {
+			t.Errorf("%s: invalid router", s)
+		}
+	}
+	if _, err := ParseRouter("xxx"); err == nil {
+		t.Error("error is not returned")
+	}
+}
+
+func TestHTTPTranslatorRouteCancel(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	client, trans := getRouteTranslator(t, proxyAddr, RouteByHost)
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan Result)
+	go func() {
+		r, _ := trans.Start(ctx)
+		results <- r
+	}()
+
+	client.Write([]byte("GET /1 HTTP/1.1\r\nHost: a.example\r\n\r\nGET /2 HTTP/1.1\r\nHost: b.example\r\n\r\n"))
+	readResponseBodies(t, client, 2)
+	cancel()
+	select {
+	case r := <-results:
+		if r.CloseReason != CloseCanceled || r.Requests != 2 || r.UpstreamStatus != 200 {
+			t.Errorf("result=%+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("translation is not canceled")
+	}
+}
+
+func TestHTTPTranslatorRouteUpgradeRefused(t *testing.T) {
+	proxyAddr, _ := startRouteProxy(t, false)
+	client, trans := getRouteTranslator(t, proxyAddr, RouteByHost)
+	go trans.Start(context.Background())
+
+	// proxy responds 200 to upgrade, so pipelined request is routed
+	client.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n" +
+		"GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	got := readResponseBodies(t, client, 2)
+	expected := []string{"http://example.com/ws", "http://example.com/a"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got=%v", got)
+	}
+}
@@ -1,9 +1,19 @@
 package traproxy
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/nyushi/traproxy/http"
 )
 
 func getHTTPTranslator(network, endpoint string) (client, proxy *net.TCPConn, trans *HTTPTranslator, err error) {
@@ -35,7 +45,7 @@ func TestHTTPTranslatorStartSuccess(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	go trans.Start()
+	go trans.Start(context.Background())
 
 	buf := make([]byte, 1024)
 	client.Write([]byte("HEAD /test HTTP/1.0\r\nHost: localhost\r\n\r\n"))
@@ -56,7 +66,7 @@ func TestHTTPTranslatorStartHasNoHostHeader(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	go trans.Start()
+	go trans.Start(context.Background())
 
 	buf := make([]byte, 1024)
 	client.Write([]byte("HEAD /test HTTP/1.0\r\n\r\n"))
@@ -77,7 +87,7 @@ func TestHTTPTranslatorStartSuccessDoNothing(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	go trans.Start()
+	go trans.Start(context.Background())
 
 	buf := make([]byte, 1024)
 	client.Write([]byte("test"))
@@ -93,8 +103,585 @@ func TestHTTPTranslatorStartNotTCP(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = trans.Start()
+	_, err = trans.Start(context.Background())
 	if err.Error() != "client socket is not tcp" {
 		t.Error("socket check failed")
 	}
 }
+
+func TestHTTPTranslatorStartBuffered(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans.Buffered = []byte("HEAD /test HTTP/1.0\r\nHo")
+	go trans.Start(context.Background())
+
+	client.Write([]byte("st: localhost\r\n\r\n"))
+
+	buf := make([]byte, 1024)
+	s, err := proxy.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[0:s])
+	expected := "HEAD http://localhost/test HTTP/1.0\r\nHost: localhost\r\n\r\n"
+	if got != expected {
+		t.Errorf("got=%s\nexpected=%s", got, expected)
+	}
+}
+
+func TestHTTPTranslatorStartResponse(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string, 2)
+	trans.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {
+		done <- fmt.Sprintf("%s %d", req.ReqLine(), resp.StatusCode)
+	}
+	go trans.Start(context.Background())
+
+	buf := make([]byte, 1024)
+	client.Write([]byte("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	readUntil(t, proxy, "GET http://localhost/a HTTP/1.1\r\nHost: localhost\r\n\r\nGET http://localhost/b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+	proxy.Write([]byte(resp))
+
+	got := ""
+	for len(got) < len(resp) {
+		s, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(buf[:s])
+	}
+	if got != resp {
+		t.Errorf("response is modified: %s", got)
+	}
+	for _, expected := range []string{"GET http://localhost/a HTTP/1.1 200", "GET http://localhost/b HTTP/1.1 404"} {
+		select {
+		case r := <-done:
+			if r != expected {
+				t.Errorf("got=%s, expected=%s", r, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("response is not tracked")
+		}
+	}
+}
+
+// startWebSocketEchoServer starts minimal websocket server echoing unmasked payload
+func startWebSocketEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				key := ""
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						break
+					}
+					if strings.HasPrefix(strings.ToLower(line), "sec-websocket-key:") {
+						key = strings.TrimSpace(line[len("sec-websocket-key:"):])
+					}
+				}
+				h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+				fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\n"+
+					"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+					"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h[:]))
+
+				for {
+					head := make([]byte, 6)
+					if _, err := io.ReadFull(r, head); err != nil {
+						return
+					}
+					payload := make([]byte, head[1]&0x7f)
+					if _, err := io.ReadFull(r, payload); err != nil {
+						return
+					}
+					for i := range payload {
+						payload[i] ^= head[2+i%4]
+					}
+					c.Write(append([]byte{head[0], byte(len(payload))}, payload...))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startFakeProxy starts http proxy which connects to origin and pipes raw bytes
+func startFakeProxy(t *testing.T, origin string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				reqLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				tokens := strings.SplitN(reqLine, " ", 3)
+				u, err := url.Parse(tokens[1])
+				if err != nil {
+					return
+				}
+				o, err := net.Dial("tcp", origin)
+				if err != nil {
+					return
+				}
+				defer o.Close()
+				fmt.Fprintf(o, "%s %s %s", tokens[0], u.RequestURI(), tokens[2])
+				go io.Copy(c, o)
+				io.Copy(o, r)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHTTPTranslatorWebSocket(t *testing.T) {
+	proxyAddr := startFakeProxy(t, startWebSocketEchoServer(t))
+	s, err := createSockets("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s.B
+	defer client.Close()
+	proxy, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans := &HTTPTranslator{TranslatorBase: TranslatorBase{Client: s.A, Proxy: proxy, Dst: "example.com:80"}}
+	go trans.Start(context.Background())
+
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	client.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	r := bufio.NewReader(client)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Fatalf("upgrade failed: %s", status)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	// payloads look like http request with zero mask to detect mangling
+	for _, msg := range []string{"GET / HTTP/1.1\r\n\r\n", "POST / HTTP/1.1\r\nContent-Length: 3\r\n\r\n"} {
+		mask := []byte{0, 0, 0, 0}
+		frame := append([]byte{0x81, 0x80 | byte(len(msg))}, mask...)
+		for i := 0; i < len(msg); i++ {
+			frame = append(frame, msg[i]^mask[i%4])
+		}
+		client.Write(frame)
+
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(r, head); err != nil {
+			t.Fatal(err)
+		}
+		payload := make([]byte, head[1])
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != msg {
+			t.Errorf("echo is mangled: got=%q, expected=%q", payload, msg)
+		}
+	}
+}
+
+func readUntil(t *testing.T, c net.Conn, expected string) string {
+	buf := make([]byte, 1024)
+	got := ""
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < len(expected) {
+		s, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("got=%q, expected=%q: %s", got, expected, err)
+		}
+		got += string(buf[:s])
+	}
+	return got
+}
+
+func TestHTTPTranslatorExpectContinue(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {}
+	go trans.Start(context.Background())
+
+	req := "PUT /a HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"
+	client.Write([]byte(req))
+	expected := "PUT http://localhost/a HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q, expected=%q", got, expected)
+	}
+
+	resp := "HTTP/1.1 100 Continue\r\n\r\n"
+	proxy.Write([]byte(resp))
+	if got := readUntil(t, client, resp); got != resp {
+		t.Errorf("got=%q, expected=%q", got, resp)
+	}
+
+	client.Write([]byte("GET "))
+	if got := readUntil(t, proxy, "GET "); got != "GET " {
+		t.Errorf("body is modified: %q", got)
+	}
+}
+
+func TestHTTPTranslatorExpectContinueRejected(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {}
+	go trans.Start(context.Background())
+
+	req := "PUT /a HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n"
+	client.Write([]byte(req))
+	expected := "PUT http://localhost/a HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n"
+	readUntil(t, proxy, expected)
+
+	resp := "HTTP/1.1 413 Payload Too Large\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+	proxy.Write([]byte(resp))
+	readUntil(t, client, resp)
+
+	// client skips body and sends next request
+	client.Write([]byte("GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	expected = "GET http://localhost/b HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q, expected=%q", got, expected)
+	}
+}
+
+func TestHTTPTranslatorHeaderRules(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {}
+	trans.HeaderRules = []HeaderRule{
+		ForwardedForRule(),
+	}
+	go trans.Start(context.Background())
+
+	client.Write([]byte("GET /a HTTP/1.1\r\nHost: localhost\r\nProxy-Connection: keep-alive\r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	expected := "GET http://localhost/a HTTP/1.1\r\nHost: localhost\r\nX-Forwarded-For: 127.0.0.1\r\n\r\n" +
+		"GET http://localhost/b HTTP/1.1\r\nHost: localhost\r\nX-Forwarded-For: 127.0.0.1\r\n\r\n"
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q, expected=%q", got, expected)
+	}
+}
+
+func TestHTTPTranslatorHeaderTooLarge(t *testing.T) {
+	var tests = []string{
+		// slowloris client never ends header
+		"GET / HTTP/1.1\r\nX-A: " + strings.Repeat("a", 100),
+		"GET / HTTP/1.1\r\nX-A: " + strings.Repeat("a", 100) + "\r\n\r\n",
+	}
+	for _, req := range tests {
+		client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trans.MaxHeaderSize = 64
+		go trans.Start(context.Background())
+
+		for i := 0; i < len(req); i += 10 {
+			end := i + 10
+			if end > len(req) {
+				end = len(req)
+			}
+			client.Write([]byte(req[i:end]))
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(http.HeaderTooLargeResponse) {
+			t.Errorf("got=%q", got)
+		}
+		proxy.SetReadDeadline(time.Now().Add(time.Second))
+		if b, _ := io.ReadAll(proxy); len(b) != 0 {
+			t.Errorf("request is sent to proxy: %q", b)
+		}
+	}
+}
+
+func TestHTTPTranslatorStreamingBody(t *testing.T) {
+	trans := &HTTPTranslator{TranslatorBase: TranslatorBase{Dst: "example.com:80"}}
+	out := trans.filterRequest([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n12"))
+	expected := "POST http://example.com:80/ HTTP/1.1\r\nContent-Length: 10\r\n\r\n12"
+	if string(out) != expected {
+		t.Errorf("got=%q, expected=%q", out, expected)
+	}
+
+	in := []byte("3456")
+	out = trans.filterRequest(in)
+	if &out[0] != &in[0] {
+		t.Error("body is copied")
+	}
+
+	out = trans.filterRequest([]byte("7890GET / HTTP/1.1\r\n"))
+	if string(out) != "7890" {
+		t.Errorf("got=%q", out)
+	}
+	out = trans.filterRequest([]byte("\r\n"))
+	if string(out) != "GET http://example.com:80/ HTTP/1.1\r\n\r\n" {
+		t.Errorf("got=%q", out)
+	}
+}
+
+var benchRequests = []byte("GET /index.html HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"User-Agent: bench\r\n" +
+	"Accept: */*\r\n" +
+	"Accept-Encoding: gzip\r\n" +
+	"Connection: keep-alive\r\n\r\n" +
+	"POST /upload HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"Content-Length: 16\r\n\r\n" +
+	"0123456789abcdef")
+
+func BenchmarkHTTPTranslatorFilterRequest(b *testing.B) {
+	trans := &HTTPTranslator{TranslatorBase: TranslatorBase{Dst: "example.com:80"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		trans.filterRequest(benchRequests)
+		trans.responses = http.ResponseTracker{}
+	}
+}
+
+func BenchmarkHTTPTranslatorFilterRequestBody(b *testing.B) {
+	trans := &HTTPTranslator{TranslatorBase: TranslatorBase{Dst: "example.com:80"}}
+	trans.filterRequest([]byte("POST / HTTP/1.1\r\nContent-Length: 1000000000000\r\n\r\n"))
+	body := make([]byte, 4096)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		trans.filterRequest(body)
+	}
+}
+
+func TestHTTPTranslatorBadRequest(t *testing.T) {
+	var tests = []string{
+		"GET / HTTP/1.1\r\nX-A: 1\r\n 2\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n",
+	}
+	for _, req := range tests {
+		client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go trans.Start(context.Background())
+
+		client.Write([]byte(req))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(http.BadRequestResponse) {
+			t.Errorf("%q: got=%q", req, got)
+		}
+		proxy.SetReadDeadline(time.Now().Add(time.Second))
+		if b, _ := io.ReadAll(proxy); len(b) != 0 {
+			t.Errorf("%q: request is sent to proxy: %q", req, b)
+		}
+	}
+}
+
+func TestHTTPTranslatorChunkedRequest(t *testing.T) {
+	trans := &HTTPTranslator{TranslatorBase: TranslatorBase{Dst: "example.com:80"}}
+	var tests = []struct {
+		in       string
+		expected string
+	}{
+		{"POST / HTTP/1.1\nTransfer-Encoding: chunked\n\n5\r\nhel",
+			"POST http://example.com:80/ HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel"},
+		// chunk data looking like request is not parsed
+		{"lo\r\n12\r\nGET / HTTP/1.1\r\n\r\n\r\n",
+			"lo\r\n12\r\nGET / HTTP/1.1\r\n\r\n\r\n"},
+		{"0\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+			"0\r\n\r\nGET http://example.com:80/ HTTP/1.1\r\n\r\n"},
+	}
+	for _, v := range tests {
+		if got := string(trans.filterRequest([]byte(v.in))); got != v.expected {
+			t.Errorf("got=%q, expected=%q", got, v.expected)
+		}
+	}
+}
+
+func TestHTTPTranslatorRequestTarget(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected string
+	}{
+		{"GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{"GET a?b HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"GET http://example.com/a?b HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{"GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{"OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"OPTIONS http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{"CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\n\r\n",
+			"CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\n\r\n"},
+	}
+	for _, v := range tests {
+		trans := &HTTPTranslator{TranslatorBase: TranslatorBase{Dst: "example.com:80"}}
+		if got := string(trans.filterRequest([]byte(v.in))); got != v.expected {
+			t.Errorf("got=%q, expected=%q", got, v.expected)
+		}
+	}
+}
+
+func TestHTTPTranslatorConnect(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer proxy.Close()
+	go trans.Start(context.Background())
+
+	connect := "CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\n\r\n"
+	// bytes in tunnel are not http
+	tunnel := "GET / HTTP/1.1\r\n\r\n"
+	// client may send before the tunnel is established.
+	// the bytes are held until the response
+	client.Write([]byte(connect + tunnel))
+	if got := readUntil(t, proxy, connect); got != connect {
+		t.Errorf("got=%q", got)
+	}
+	established := "HTTP/1.1 200 Connection established\r\n\r\n"
+	proxy.Write([]byte(established))
+	if got := readUntil(t, client, established); got != established {
+		t.Errorf("got=%q", got)
+	}
+	if got := readUntil(t, proxy, tunnel); got != tunnel {
+		t.Errorf("got=%q", got)
+	}
+	client.Write([]byte(tunnel))
+	if got := readUntil(t, proxy, tunnel); got != tunnel {
+		t.Errorf("got=%q", got)
+	}
+}
+
+func TestHTTPTranslatorUpgradeRefused(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer proxy.Close()
+	done := make(chan string, 2)
+	trans.OnResponse = func(req *http.RequestHeader, resp *http.ResponseHeader) {
+		done <- fmt.Sprintf("%s %d", req.ReqLine(), resp.StatusCode)
+	}
+	go trans.Start(context.Background())
+
+	upgrade := "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	client.Write([]byte(upgrade + "GET /a HTTP/1.1\r\nHost: localhost\r\nProxy-Connection: keep-alive\r\n\r\n"))
+	expected := "GET http://localhost/ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q", got)
+	}
+	resp := "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"
+	proxy.Write([]byte(resp))
+	if got := readUntil(t, client, resp); got != resp {
+		t.Errorf("got=%q", got)
+	}
+	// pipelined request is rewritten after the upgrade is refused
+	expected = "GET http://localhost/a HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	if got := readUntil(t, proxy, expected); got != expected {
+		t.Errorf("got=%q", got)
+	}
+	resp = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	proxy.Write([]byte(resp))
+	if got := readUntil(t, client, resp); got != resp {
+		t.Errorf("got=%q", got)
+	}
+	for _, expected := range []string{"GET http://localhost/ws HTTP/1.1 400", "GET http://localhost/a HTTP/1.1 200"} {
+		select {
+		case r := <-done:
+			if r != expected {
+				t.Errorf("got=%s, expected=%s", r, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("response is not tracked")
+		}
+	}
+}
+
+func TestHTTPTranslatorResult(t *testing.T) {
+	client, proxy, trans, err := getHTTPTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	trans.ID = 7
+	results := make(chan Result)
+	go func() {
+		r, _ := trans.Start(context.Background())
+		results <- r
+	}()
+
+	req := "GET /1 HTTP/1.1\r\nHost: example.com\r\n\r\nGET /2 HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	client.Write([]byte(req))
+	readUntil(t, proxy, strings.Replace(strings.Replace(req, "/1", "http://example.com/1", 1), "/2", "http://example.com/2", 1))
+	resp := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\nHTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+	proxy.Write([]byte(resp))
+	readUntil(t, client, resp)
+	proxy.Close()
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("EOF is not sent to client")
+	}
+	client.Close()
+
+	r := <-results
+	expected := Result{ID: 7, Sent: int64(len(req)), Received: int64(len(resp)), Requests: 2,
+		CloseReason: CloseUpstream, UpstreamStatus: 404}
+	if r != expected {
+		t.Errorf("result=%+v", r)
+	}
+}
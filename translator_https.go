@@ -2,8 +2,9 @@ package traproxy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"sync"
+	"strconv"
 )
 
 // HTTPSTranslator is translator for https connection
@@ -11,17 +12,28 @@ type HTTPSTranslator struct {
 	TranslatorBase
 }
 
-func (t *HTTPSTranslator) isConnectSucceeded(resp []byte) bool {
+// connectStatus returns status code in response of CONNECT
+func (t *HTTPSTranslator) connectStatus(resp []byte) int {
 	lines := bytes.Split(resp, []byte("\r\n"))
 	tokens := bytes.Split(lines[0], []byte(" "))
-	if bytes.Equal(tokens[1], []byte("200")) {
-		return true
+	if len(tokens) < 2 {
+		return 0
+	}
+	code, err := strconv.Atoi(string(tokens[1]))
+	if err != nil {
+		return 0
 	}
-	return false
+	return code
+}
+
+func (t *HTTPSTranslator) isConnectSucceeded(resp []byte) bool {
+	code := t.connectStatus(resp)
+	t.setUpstreamStatus(code)
+	return code == 200
 }
 
 func (t *HTTPSTranslator) prepare() error {
-	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", t.Dst)
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", t.DstHostPort())
 	_, err := t.Proxy.Write([]byte(req))
 	if err != nil {
 		return fmt.Errorf("failed to write at CONNECT: %s", err.Error())
@@ -33,6 +45,7 @@ func (t *HTTPSTranslator) prepare() error {
 	if err != nil {
 		return fmt.Errorf("failed to read at CONNECT: %s", err.Error())
 	}
+	t.addReceived(size)
 	ok := t.isConnectSucceeded(buf[:size])
 	if !ok {
 		return fmt.Errorf("error response at CONNECT request: %s", string(buf[:size]))
@@ -41,31 +54,20 @@ func (t *HTTPSTranslator) prepare() error {
 }
 
 // Start starts translation for https
-func (t *HTTPSTranslator) Start() error {
+func (t *HTTPSTranslator) Start(ctx context.Context) (Result, error) {
+	defer t.start(ctx, nil)()
 	client, proxy, err := t.CheckSockets()
 	if err != nil {
-		return err
+		return t.result(err)
 	}
 
 	err = t.prepare()
 	if err != nil {
-		return err
+		return t.result(err)
 	}
-
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		defer t.HandlePanic()
-
-		Pipe(client, proxy, nil)
-	}()
-	go func() {
-		defer wg.Done()
-		defer t.HandlePanic()
-
-		Pipe(proxy, client, nil)
-	}()
-	wg.Wait()
-	return nil
+	if err := t.WriteBuffered(nil); err != nil {
+		return t.result(err)
+	}
+	t.pipeBoth(client, proxy, nil, nil)
+	return t.result(nil)
 }
@@ -1,9 +1,11 @@
 package traproxy
 
 import (
+	"context"
 	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func getHTTPSTranslator(network, endpoint string) (client, proxy *net.TCPConn, trans *HTTPSTranslator, err error) {
@@ -35,7 +37,7 @@ func TestHTTPSTranslatorStartSuccess(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	go trans.Start()
+	go trans.Start(context.Background())
 
 	buf := make([]byte, 1024)
 	s, err := proxy.Read(buf)
@@ -70,7 +72,8 @@ func TestHTTPSTranslatorStartResponseError(t *testing.T) {
 		t.Error(err)
 	}
 	go func() {
-		c <- trans.Start()
+		_, err := trans.Start(context.Background())
+		c <- err
 	}()
 
 	buf := make([]byte, 1024)
@@ -99,7 +102,7 @@ func TestHTTPSTranslatorStartWriteError(t *testing.T) {
 	}
 	proxy := trans.Proxy.(*net.TCPConn)
 	proxy.CloseWrite()
-	err = trans.Start()
+	_, err = trans.Start(context.Background())
 	if !strings.Contains(err.Error(), "failed to write at CONNECT:") {
 		t.Error("write error not returned")
 	}
@@ -112,7 +115,7 @@ func TestHTTPSTranslatorStartReadError(t *testing.T) {
 	}
 	proxy := trans.Proxy.(*net.TCPConn)
 	proxy.CloseRead()
-	err = trans.Start()
+	_, err = trans.Start(context.Background())
 	if err.Error() != "failed to read at CONNECT: EOF" {
 		t.Error("write error not returned")
 	}
@@ -123,8 +126,42 @@ func TestHTTPSTranslatorStartNotTCP(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = trans.Start()
+	_, err = trans.Start(context.Background())
 	if err.Error() != "client socket is not tcp" {
 		t.Error("socket check failed")
 	}
 }
+
+func TestHTTPSTranslatorCancel(t *testing.T) {
+	client, proxy, trans, err := getHTTPSTranslator("tcp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer proxy.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan Result)
+	go func() {
+		r, _ := trans.Start(ctx)
+		results <- r
+	}()
+
+	readUntil(t, proxy, "CONNECT example.com HTTP/1.1\r\n\r\n")
+	proxy.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	client.Write([]byte("hello"))
+	readUntil(t, proxy, "hello")
+
+	cancel()
+	select {
+	case r := <-results:
+		expected := Result{Sent: 5, Received: 39, CloseReason: CloseCanceled, UpstreamStatus: 200}
+		if r != expected {
+			t.Errorf("result=%+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("translation is not canceled")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("client is not closed")
+	}
+}
@@ -126,3 +126,19 @@ func TestTranslatorBaseHandlePanic(t *testing.T) {
 	}
 	log.SetOutput(os.Stdout)
 }
+
+func TestTranslatorBaseDstHostPort(t *testing.T) {
+	var tests = []struct {
+		base     TranslatorBase
+		expected string
+	}{
+		{TranslatorBase{Dst: "192.0.2.1:443"}, "192.0.2.1:443"},
+		{TranslatorBase{Dst: "192.0.2.1:443", DstName: "example.com"}, "example.com:443"},
+		{TranslatorBase{Dst: "invalid", DstName: "example.com"}, "invalid"},
+	}
+	for _, v := range tests {
+		if got := v.base.DstHostPort(); got != v.expected {
+			t.Errorf("got=%s, expected=%s", got, v.expected)
+		}
+	}
+}
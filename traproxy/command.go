@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/nyushi/traproxy/docker"
+	"github.com/nyushi/traproxy/firewall"
+)
+
+// commands are subcommands run instead of proxy
+var commands = map[string]string{
+	"rules":   "print firewall rules set by the options",
+	"status":  "check whether firewall rules are installed. exits with 1 if some rules are missing or extra",
+	"cleanup": "remove all installed firewall rules of traproxy without starting proxy",
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\nCommands:\n", os.Args[0])
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name])
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs command for firewall rules and returns exit status
+func runCommand(command string, fw firewall.Firewall, withDocker bool, dockerSocket string) int {
+	rfw, ok := fw.(firewall.RuleFirewall)
+	if !ok {
+		log.Printf("%s requires firewall. -with-fw is disabled or not supported", command)
+		return 2
+	}
+	bridges := map[string][]string{}
+	if withDocker {
+		bs, err := docker.NewClient(dockerSocket).Bridges()
+		if err != nil {
+			log.Printf("bridge rules are skipped: %s", err)
+		}
+		for _, b := range bs {
+			bridges[b.Name] = b.Bypasses
+		}
+	}
+
+	switch command {
+	case "rules":
+		rules, err := rfw.Rules(bridges)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		for _, r := range rules {
+			fmt.Println(r.GetCommandStr())
+		}
+		return 0
+	case "status":
+		st, err := rfw.Status(bridges)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		return printStatus(st)
+	case "cleanup":
+		if err := rfw.Cleanup(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+	return 2
+}
+
+// printStatus prints status of rules and returns 0 if all rules are installed
+// and no extra rule is installed
+func printStatus(st []firewall.RuleStatus) int {
+	installed, missing, extra := 0, 0, 0
+	for _, s := range st {
+		state := "missing"
+		switch {
+		case s.Extra:
+			state = "extra"
+			extra++
+		case s.Installed:
+			state = "ok"
+			installed++
+		default:
+			missing++
+		}
+		fmt.Printf("%-7s %s\n", state, s.Rule.GetCommandStr())
+	}
+	switch {
+	case missing == 0 && extra == 0:
+		fmt.Printf("installed: %d rules\n", installed)
+		return 0
+	case installed == 0 && extra == 0:
+		fmt.Printf("not installed: %d rules\n", missing)
+	default:
+		fmt.Printf("drift: %d of %d rules are missing, %d extra rules are installed\n", missing, installed+missing, extra)
+	}
+	return 1
+}
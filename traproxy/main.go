@@ -1,32 +1,48 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	nethttp "net/http"
 	"os"
 	"os/signal"
+	"os/user"
 	"runtime"
-	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/nyushi/traproxy"
+	"github.com/nyushi/traproxy/dns"
+	"github.com/nyushi/traproxy/docker"
 	"github.com/nyushi/traproxy/firewall"
+	"github.com/nyushi/traproxy/http"
+	"github.com/nyushi/traproxy/netns"
 	"github.com/nyushi/traproxy/orgdst"
+	"github.com/nyushi/traproxy/privilege"
+	"github.com/nyushi/traproxy/systemd"
 )
 
-type destination string
-
-func (d *destination) Port() string {
-	str := string(*d)
-	_, port, _ := net.SplitHostPort(str)
-	return port
-}
-
 var (
-	dst *destination
+	mode         firewall.Mode
+	dnsCache     *dns.Cache
+	excludeNames []string
+	headerRules  []traproxy.HeaderRule
+	h2cMode      traproxy.H2CMode
+	router       func(*http.RequestHeader) traproxy.Route
+	pool         *traproxy.Pool
+	netnsPath    string
+
+	// fwMu guards fwUp which is true while firewall rules may be set
+	fwMu sync.Mutex
+	fwUp bool
 )
 
 type excludeOptions []string
@@ -41,6 +57,67 @@ func (e *excludeOptions) Set(val string) error {
 	return nil
 }
 
+type headerOptions []traproxy.HeaderRule
+
+func (h *headerOptions) String() string {
+	return fmt.Sprint(*h)
+}
+func (h *headerOptions) Set(val string) error {
+	r, err := traproxy.ParseHeaderRule(val)
+	if err != nil {
+		return err
+	}
+	*h = append(*h, r)
+	return nil
+}
+
+// splitAddrs splits excludes into ip addresses and domain names
+func (e *excludeOptions) splitAddrs() (addrs []string, names []string) {
+	for _, v := range *e {
+		if net.ParseIP(v) != nil {
+			addrs = append(addrs, v)
+			continue
+		}
+		if _, _, err := net.ParseCIDR(v); err == nil {
+			addrs = append(addrs, v)
+			continue
+		}
+		names = append(names, strings.ToLower(v))
+	}
+	return addrs, names
+}
+
+// isExcludedName reports whether name matches excluded names.
+// "*.example.com" matches any subdomain of example.com
+func isExcludedName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, e := range excludeNames {
+		if strings.HasPrefix(e, "*.") {
+			if strings.HasSuffix(name, e[1:]) {
+				return true
+			}
+			continue
+		}
+		if name == e {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvableNames returns excluded names which are not wildcard
+func resolvableNames() []string {
+	names := []string{}
+	for _, e := range excludeNames {
+		if !strings.HasPrefix(e, "*.") {
+			names = append(names, e)
+		}
+	}
+	return names
+}
+
 func main() {
 	var withFirewallNat *bool
 	showVersion := flag.Bool("V", false, "show version")
@@ -48,26 +125,106 @@ func main() {
 	excludeReservedAddrs := flag.Bool("exclude-reserved-addrs", true, "exclude reserved ip addresses")
 	forceDstAddr := flag.String("dstaddr", "", "DEBUG force set to destination address")
 	proxyAddr := flag.String("proxyaddr", "", "proxy address. '<host>:<port>'")
+	modeName := flag.String("mode", "redirect", "redirect mode. 'redirect' or 'tproxy'")
 	if runtime.GOOS == "linux" {
 		withFirewallNat = flag.Bool("with-fw-nat", true, "edit iptables rule with nat")
 	} else {
 		b := true
 		withFirewallNat = &b
 	}
-	var excludeAddrs excludeOptions
-	flag.Var(&excludeAddrs, "exclude", "network addr to exclude")
+	withDocker := flag.Bool("with-docker", false, "redirect only traffic from docker bridge networks")
+	dockerSocket := flag.String("docker-socket", docker.DefaultSocket, "docker api socket path")
+	withDNS := flag.Bool("with-dns", false, "intercept dns queries and forward them to -dns-upstream")
+	dnsUpstream := flag.String("dns-upstream", "", "upstream dns server. '<host>:<port>'")
+	addVia := flag.Bool("add-via", false, "add Via header to http requests")
+	addXFF := flag.Bool("add-xff", false, "add client address to X-Forwarded-For header of http requests")
+	h2cModeName := flag.String("h2c", "tunnel", "how to send http/2 cleartext connections to proxy. 'tunnel' or 'translate'")
+	routeName := flag.String("http-route", "connection", "upstream connection for http requests. 'connection', 'host' or 'request'")
+	poolMaxIdle := flag.Int("pool-max-idle", 0, "max idle upstream connections kept for http. 0 disables pooling")
+	poolMaxPerHost := flag.Int("pool-max-per-host", 0, "max upstream connections for http per address. 0 is unlimited")
+	poolIdleTimeout := flag.Duration("pool-idle-timeout", traproxy.DefaultPoolIdleTimeout, "time to keep idle upstream connection")
+	poolWaitTimeout := flag.Duration("pool-wait-timeout", traproxy.DefaultPoolWaitTimeout, "time to wait for upstream connection over -pool-max-per-host")
+	adminAddr := flag.String("admin-addr", "", "address to serve metrics at /debug/vars. '<host>:<port>'")
+	userName := flag.String("user", "", "user to run as after firewall setup. CAP_NET_ADMIN and CAP_NET_RAW are kept for firewall")
+	teardownOnly := flag.Bool("teardown", false, "remove firewall rules set by the options and exit. same as cleanup command")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "time to wait for connections to finish at shutdown")
+	flag.StringVar(&netnsPath, "netns", "", "network namespace path for listener and firewall. '/var/run/netns/<name>' or '/proc/<pid>/ns/net'")
+	var headers headerOptions
+	flag.Var(&headers, "header", "rewrite rule for http request headers. '<add|set|append|del>:<name>[:<value>]'")
+	var excludes excludeOptions
+	flag.Var(&excludes, "exclude", "network addr or domain name to exclude")
+	command := ""
+	if len(os.Args) > 1 && commands[os.Args[1]] != "" {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	flag.Usage = usage
 	flag.Parse()
+	if *teardownOnly && command == "" {
+		command = "cleanup"
+	}
 
 	if *showVersion {
 		fmt.Printf("%s(%s)\n", traproxy.Version, traproxy.GitHash)
 		os.Exit(0)
 	}
 
+	if *addVia {
+		headerRules = append(headerRules, traproxy.ViaRule())
+	}
+	if *addXFF {
+		headerRules = append(headerRules, traproxy.ForwardedForRule())
+	}
+	headerRules = append(headerRules, headers...)
+
+	excludeAddrs, names := excludes.splitAddrs()
+	excludeNames = names
+	if *withDNS && *dnsUpstream == "" {
+		log.Fatal("-with-dns requires -dns-upstream")
+	}
+
+	var err error
+	mode, err = firewall.ParseMode(*modeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h2cMode, err = traproxy.ParseH2CMode(*h2cModeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	router, err = traproxy.ParseRouter(*routeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mode == firewall.ModeTProxy && runtime.GOOS != "linux" {
+		log.Fatal("tproxy mode is only supported on linux")
+	}
+	if mode == firewall.ModeTProxy && *withDocker {
+		log.Fatal("tproxy mode can not be used with -with-docker")
+	}
+	if netnsPath != "" {
+		if runtime.GOOS != "linux" {
+			log.Fatal("-netns is only supported on linux")
+		}
+		if *withDocker {
+			log.Fatal("-netns can not be used with -with-docker")
+		}
+		if *userName != "" {
+			// entering namespace for firewall commands requires CAP_SYS_ADMIN
+			log.Fatal("-netns can not be used with -user")
+		}
+	}
 	fwc := &firewall.Config{
+		Mode:            mode,
 		ProxyAddr:       proxyAddr,
 		WithNat:         *withFirewallNat,
+		WithDocker:      *withDocker,
+		WithDNS:         *withDNS,
+		DNSUpstream:     *dnsUpstream,
 		ExcludeReserved: *excludeReservedAddrs,
 		Excludes:        excludeAddrs,
+		DynamicExcludes: runtime.GOOS == "linux" && len(resolvableNames()) > 0,
+		Netns:           netnsPath,
 	}
 	if *withFirewall {
 		switch runtime.GOOS {
@@ -78,6 +235,45 @@ func main() {
 		}
 	}
 	fw := firewall.New(fwc)
+	if command != "" {
+		os.Exit(runCommand(command, fw, *withDocker, *dockerSocket))
+	}
+
+	if *poolMaxIdle > 0 {
+		if router != nil {
+			log.Fatal("-pool-max-idle requires -http-route connection")
+		}
+		pool = &traproxy.Pool{
+			MaxIdle:     *poolMaxIdle,
+			MaxPerHost:  *poolMaxPerHost,
+			IdleTimeout: *poolIdleTimeout,
+			WaitTimeout: *poolWaitTimeout,
+		}
+		expvar.Publish("pool", expvar.Func(func() interface{} { return pool.Stats() }))
+	}
+
+	resolver := orgdst.DefaultResolver()
+	if mode == firewall.ModeTProxy {
+		resolver = orgdst.TProxyResolver{}
+	}
+	if *forceDstAddr != "" {
+		resolver = orgdst.StaticResolver{Dst: *forceDstAddr}
+	}
+	srv := &traproxy.Server{
+		ProxyAddr:     *proxyAddr,
+		Resolver:      resolver,
+		NewTranslator: newTranslator,
+		LookupName:    lookupName,
+		Exclude:       isExcludedName,
+		SniffName:     len(excludeNames) > 0,
+		Pool:          pool,
+	}
+	expvar.Publish("server", expvar.Func(func() interface{} { return srv.Stats() }))
+	if *adminAddr != "" {
+		if err := startAdminServer(*adminAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc,
@@ -86,103 +282,373 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
+	// watchers update firewall rules until stopped
+	watchStop := make(chan struct{})
+	stopWatchers := sync.OnceFunc(func() { close(watchStop) })
 	tearDown := func() {
-		if err := fw.Teardown(); err != nil {
-			log.Printf("error at teardown: %s", err)
-		}
+		stopWatchers()
+		stopFirewall(fw)
 		log.Println("finished")
 		os.Exit(0)
 	}
 
+	// firewall rules are removed before waiting for connections
+	// so that new connections are not redirected to closed listener
+	srv.RegisterOnShutdown(func() {
+		stopWatchers()
+		stopFirewall(fw)
+	})
+	// watchdog pings while server is alive until shutdown
+	watchdogInterval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Printf("watchdog is disabled: %s", err)
+	}
+	if watchdogInterval > 0 {
+		srv.Heartbeat = watchdogInterval / 4
+	}
+	watchdogStop := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
-		<-sigc
-		tearDown()
+		sig := <-sigc
+		log.Printf("received %s. draining connections for %s", sig, *drainTimeout)
+		close(watchdogStop)
+		notify(systemd.Stopping)
+		go func() {
+			<-sigc
+			log.Println("received signal again. closing connections")
+			srv.Close()
+		}()
+		shutdownServer(srv, *drainTimeout)
+		close(stopped)
 	}()
 
 	if *withFirewall {
-		if err := fw.Setup(); err != nil {
+		if err := setupFirewall(fw); err != nil {
 			log.Printf("firewall setup failed. shutting down: %s", err)
 			tearDown()
 		}
 	}
 
-	if *forceDstAddr != "" {
-		d := destination(*forceDstAddr)
-		dst = &d
+	if *withDNS {
+		dnsCache = dns.NewCache()
+		if err := startDNSServer(srv, *dnsUpstream); err != nil {
+			log.Printf("dns setup failed. shutting down: %s", err)
+			tearDown()
+		}
+	}
+
+	if names := resolvableNames(); *withFirewall && len(names) > 0 {
+		if err := watchExcludeNames(fw, names, *dnsUpstream, watchStop); err != nil {
+			log.Printf("exclude setup failed. shutting down: %s", err)
+			tearDown()
+		}
+	}
+
+	if *withFirewall && *withDocker {
+		bfw, ok := fw.(firewall.BridgeFirewall)
+		if !ok {
+			log.Printf("firewall does not support docker. shutting down")
+			tearDown()
+		}
+		c := docker.NewClient(*dockerSocket)
+		if err := syncDockerBridges(c, bfw); err != nil {
+			log.Printf("docker setup failed. shutting down: %s", err)
+			tearDown()
+		}
+		go watchDocker(c, bfw, watchStop)
+	}
+
+	ln, err := listen()
+	if err != nil {
+		log.Println(err)
+		tearDown()
+	}
+	if *userName != "" {
+		var caps []privilege.Cap
+		if *withFirewall {
+			// rules are updated and removed by iptables after setup.
+			// iptables-legacy also opens raw socket
+			caps = append(caps, privilege.CapNetAdmin, privilege.CapNetRaw)
+		}
+		if err := dropPrivilege(*userName, caps); err != nil {
+			log.Printf("failed to drop privilege. shutting down: %s", err)
+			tearDown()
+		}
 	}
-	if err := startServer(*proxyAddr); err != nil {
+	notify(systemd.Ready)
+	if watchdogInterval > 0 {
+		go systemd.Watchdog(watchdogInterval, srv.Alive, watchdogStop)
+	}
+	log.Println("start server")
+	if err := srv.Serve(ln); err != traproxy.ErrServerClosed {
 		log.Println(err)
+		tearDown()
 	}
+	<-stopped
 	tearDown()
 }
 
-func getDst(c net.Conn) (destination, error) {
-	if dst != nil {
-		return *dst, nil
-	}
-	d, err := orgdst.GetOriginalDst(c)
-	dst := destination(d)
-	return dst, err
+// setupFirewall sets firewall rules which are removed by stopFirewall
+func setupFirewall(fw firewall.Firewall) error {
+	fwMu.Lock()
+	defer fwMu.Unlock()
+	fwUp = true
+	return fw.Setup()
 }
 
-// StartProxy starts proxy process with client and proxy sockets
-func StartProxy(client net.Conn, proxy net.Conn) {
-	dst, err := getDst(client)
-	if err != nil {
-		log.Println(err)
+// stopFirewall removes firewall rules if set
+func stopFirewall(fw firewall.Firewall) {
+	fwMu.Lock()
+	defer fwMu.Unlock()
+	if !fwUp {
 		return
 	}
-	log.Println(dst)
+	fwUp = false
+	if err := fw.Teardown(); err != nil {
+		log.Printf("error at teardown: %s", err)
+	}
+}
 
-	tbase := traproxy.TranslatorBase{
-		Client: client,
-		Proxy:  proxy,
-		Dst:    string(dst),
+// shutdownServer waits for connections to finish until timeout and closes the rest
+func shutdownServer(srv *traproxy.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("drain timeout exceeded. closing connections")
+		srv.Close()
+		// waits for closed connections to log results
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}
+	if pool != nil {
+		pool.CloseIdle()
 	}
+	st := srv.Stats()
+	log.Printf("drained %d connections, killed %d connections", st.Drained, st.Killed)
+}
 
-	var t traproxy.Translator
-	if dst.Port() == "80" {
-		t = &traproxy.HTTPTranslator{TranslatorBase: tbase}
-	} else {
-		t = &traproxy.HTTPSTranslator{TranslatorBase: tbase}
+// startDNSServer serves dns until srv is shut down
+func startDNSServer(srv *traproxy.Server, upstream string) error {
+	s := &dns.Server{Upstream: upstream, Cache: dnsCache}
+	var pc net.PacketConn
+	var ln net.Listener
+	err := inNetns(func() error {
+		var err error
+		pc, err = net.ListenPacket("udp", ":"+firewall.DNSPort)
+		if err != nil {
+			return err
+		}
+		ln, err = net.Listen("tcp", ":"+firewall.DNSPort)
+		if err != nil {
+			pc.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	// hooks run in order, so dns redirect is removed before listeners are closed
+	srv.RegisterOnShutdown(func() {
+		pc.Close()
+		ln.Close()
+	})
+	go func() {
+		log.Printf("dns udp server stopped: %s", s.ServeUDP(pc))
+	}()
+	go func() {
+		log.Printf("dns tcp server stopped: %s", s.ServeTCP(ln))
+	}()
+	return nil
+}
 
-	err = t.Start()
+// startAdminServer serves expvar metrics
+func startAdminServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	go func() {
+		log.Printf("admin server stopped: %s", nethttp.Serve(ln, nil))
+	}()
+	return nil
 }
 
-func handleClient(proxyAddr string, client net.Conn) {
-	defer client.Close()
-	defer func() {
-		if e := recover(); e != nil {
-			log.Printf("%s: %s", e, debug.Stack())
+func watchExcludeNames(fw firewall.Firewall, names []string, server string, stop <-chan struct{}) error {
+	dfw, ok := fw.(firewall.DynamicExcludeFirewall)
+	if !ok {
+		log.Printf("firewall does not support excluding names. names are matched at connection")
+		return nil
+	}
+	if server == "" {
+		var err error
+		server, err = dns.SystemServer()
+		if err != nil {
+			return err
 		}
-	}()
+	}
+	w := &dns.NameWatcher{
+		Server: server,
+		Names:  names,
+		OnChange: func(addrs []string) {
+			if err := dfw.SetDynamicExcludes(addrs); err != nil {
+				log.Printf("failed to update excludes: %s", err)
+			}
+		},
+	}
+	return w.Start(stop)
+}
 
-	proxy, err := net.Dial("tcp", proxyAddr)
+func syncDockerBridges(c *docker.Client, fw firewall.BridgeFirewall) error {
+	bridges, err := c.Bridges()
 	if err != nil {
-		log.Printf("failed to connect proxy: %s\n", err.Error())
-		return
+		return err
+	}
+	current := map[string]bool{}
+	for _, b := range bridges {
+		current[b.Name] = true
+		if err := fw.SetBridge(b.Name, b.Bypasses); err != nil {
+			return fmt.Errorf("failed to set rules for %s: %s", b.Name, err)
+		}
+	}
+	for _, name := range fw.Bridges() {
+		if current[name] {
+			continue
+		}
+		if err := fw.RemoveBridge(name); err != nil {
+			return fmt.Errorf("failed to remove rules for %s: %s", name, err)
+		}
 	}
-	defer proxy.Close()
+	return nil
+}
 
-	StartProxy(client, proxy)
+// watchDocker syncs rules of bridges on docker events until stop is closed
+func watchDocker(c *docker.Client, fw firewall.BridgeFirewall, stop <-chan struct{}) {
+	for {
+		err := c.Watch(stop, func(e docker.Event) {
+			if !e.IsBridgeChange() {
+				return
+			}
+			log.Printf("docker %s %s: %s", e.Type, e.Action, e.Actor.ID)
+			if err := syncDockerBridges(c, fw); err != nil {
+				log.Printf("failed to sync docker bridges: %s", err)
+			}
+		})
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("docker event watch stopped: %s", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+		if err := syncDockerBridges(c, fw); err != nil {
+			log.Printf("failed to sync docker bridges: %s", err)
+		}
+	}
+}
+
+func lookupName(host string) string {
+	if dnsCache == nil {
+		return ""
+	}
+	name, _ := dnsCache.Lookup(host)
+	return name
+}
+
+// newTranslator returns translator configured by options
+func newTranslator(base traproxy.TranslatorBase, direct bool) traproxy.Translator {
+	t := traproxy.DefaultTranslator(base, direct)
+	if ht, ok := t.(*traproxy.HTTPTranslator); ok {
+		ht.HeaderRules = headerRules
+		ht.H2C = h2cMode
+		ht.Router = router
+	}
+	return t
+}
+
+// inNetns runs f in network namespace of -netns if set
+func inNetns(f func() error) error {
+	if netnsPath == "" {
+		return f()
+	}
+	return netns.Do(netnsPath, f)
+}
+
+// listen returns listener passed by systemd socket activation, or listens on DefaultAddr
+func listen() (net.Listener, error) {
+	lns, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(lns) > 0 && netnsPath != "" {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, errors.New("activated sockets can not be used with -netns")
+	}
+	if len(lns) > 0 {
+		for _, ln := range lns[1:] {
+			log.Printf("ignore activated socket %s", ln.Addr())
+			ln.Close()
+		}
+		log.Printf("use activated socket %s", lns[0].Addr())
+		return lns[0], nil
+	}
+	var ln net.Listener
+	err = inNetns(func() error {
+		var err error
+		if mode == firewall.ModeTProxy {
+			ln, err = orgdst.ListenTransparent(traproxy.DefaultAddr)
+		} else {
+			ln, err = net.Listen("tcp", traproxy.DefaultAddr)
+		}
+		return err
+	})
+	return ln, err
 }
 
-func startServer(proxyAddr string) error {
-	ln, err := net.Listen("tcp", ":10080")
+// dropPrivilege changes user to name keeping caps
+func dropPrivilege(name string, caps []privilege.Cap) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %s: %s", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %s: %s", u.Gid, err)
+	}
+	ids, err := u.GroupIds()
 	if err != nil {
 		return err
 	}
-	log.Println("start server")
-	for {
-		client, err := ln.Accept()
+	groups := []int{}
+	for _, id := range ids {
+		g, err := strconv.Atoi(id)
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid gid %s: %s", id, err)
 		}
+		groups = append(groups, g)
+	}
+	if err := privilege.Drop(uid, gid, groups, caps...); err != nil {
+		return err
+	}
+	log.Printf("running as %s(%d)", u.Username, uid)
+	return nil
+}
 
-		go handleClient(proxyAddr, client)
+// notify sends state to systemd if run as notify service
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Printf("failed to notify %s: %s", state, err)
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +23,11 @@ var pipeBufPool = sync.Pool{
 
 // Pipe starts bridging with two tcp connection
 func Pipe(dst tcpconn, src tcpconn, f *func([]byte) []byte) error {
+	return pipe(dst, src, f, nil)
+}
+
+// pipe is Pipe adding bytes read from src to n if not nil
+func pipe(dst tcpconn, src tcpconn, f *func([]byte) []byte, n *int64) error {
 	defer src.CloseRead()
 	defer dst.CloseWrite()
 
@@ -38,6 +44,9 @@ func Pipe(dst tcpconn, src tcpconn, f *func([]byte) []byte) error {
 			}
 			return err
 		}
+		if n != nil {
+			atomic.AddInt64(n, int64(rsize))
+		}
 
 		var wb []byte
 		if f != nil {